@@ -26,7 +26,17 @@ func (h *Handler) Handle(c *proxy.Context) {
 
 	delay := reservation.Delay()
 	if delay > 0 {
-		time.Sleep(delay)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-c.Ctx().Done():
+			// the client is gone, so the reserved token is returned to the limiter
+			reservation.Cancel()
+			c.Response = &http.Response{StatusCode: http.StatusServiceUnavailable}
+			return
+		}
 	}
 
 	c.Next()
@@ -6,6 +6,7 @@
 package limiter
 
 import (
+	"context"
 	"github.com/pmateusz/glove/pkg/proxy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -71,3 +72,26 @@ func TestCanRejectInfeasibleRequest(t *testing.T) {
 	}
 	handler.AssertNotCalled(t, "Handle", mock.Anything)
 }
+
+func TestStopsThrottlingCancelledRequest(t *testing.T) {
+	// GIVEN
+	handler := new(mockHandler)
+	ctx := proxy.NewTestOnlyContext(handler.Handle)
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.SetCtx(cancelledCtx)
+	innerLimiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter := &Handler{innerLimiter}
+
+	// WHEN
+	innerLimiter.Allow()
+	limiter.Handle(ctx)
+
+	// THEN
+	if assert.NotNil(t, ctx.Response) {
+		assert.Equal(t, http.StatusServiceUnavailable, ctx.Response.StatusCode)
+	}
+	handler.AssertNotCalled(t, "Handle", mock.Anything)
+	// the token reserved by the cancelled request is returned
+	assert.InDelta(t, 0.0, innerLimiter.Tokens(), 0.01)
+}
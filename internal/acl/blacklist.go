@@ -0,0 +1,23 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import "net"
+
+// Blacklist denies IP addresses and CIDR masks added to the list and allows any other address.
+type Blacklist struct {
+	list *Whitelist
+}
+
+func NewBlacklist(opts ...WhitelistOption) *Blacklist {
+	return &Blacklist{
+		list: NewWhitelist(opts...),
+	}
+}
+
+func (b *Blacklist) Allowed(ip net.IP) bool {
+	return !b.list.Allowed(ip)
+}
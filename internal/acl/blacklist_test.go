@@ -0,0 +1,52 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestCreateEmptyBlacklist(t *testing.T) {
+	// GIVEN
+	acl := NewBlacklist()
+
+	// WHEN
+	allowed := acl.Allowed(localhost)
+
+	// THEN
+	assert.True(t, allowed)
+}
+
+func TestCreateBlacklistWithIP(t *testing.T) {
+	// GIVEN
+	acl := NewBlacklist(WithIP(localhost))
+
+	// WHEN
+	denyLocalhost := acl.Allowed(localhost)
+	allowOther := acl.Allowed(net.IPv4(127, 0, 0, 2))
+
+	// THEN
+	assert.False(t, denyLocalhost)
+	assert.True(t, allowOther)
+}
+
+func TestCreateBlacklistWithMask(t *testing.T) {
+	// GIVEN
+	_, network, parseErr := net.ParseCIDR("127.0.0.1/8")
+	require.NoError(t, parseErr)
+	acl := NewBlacklist(WithMask(*network))
+
+	// WHEN
+	denyLocalhost := acl.Allowed(localhost)
+	allowOutsideMask := acl.Allowed(net.IPv4(128, 0, 0, 1))
+
+	// THEN
+	assert.False(t, denyLocalhost)
+	assert.True(t, allowOutsideMask)
+}
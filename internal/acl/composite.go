@@ -0,0 +1,53 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import "net"
+
+type allOf []ACL
+
+// AllOf allows an IP address if it is allowed by every ACL. AllOf with no ACLs allows any address.
+func AllOf(acls ...ACL) ACL {
+	return allOf(acls)
+}
+
+func (a allOf) Allowed(ip net.IP) bool {
+	for _, acl := range a {
+		if !acl.Allowed(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyOf []ACL
+
+// AnyOf allows an IP address if it is allowed by at least one ACL. AnyOf with no ACLs denies any address.
+func AnyOf(acls ...ACL) ACL {
+	return anyOf(acls)
+}
+
+func (a anyOf) Allowed(ip net.IP) bool {
+	for _, acl := range a {
+		if acl.Allowed(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type not struct {
+	acl ACL
+}
+
+// Not allows an IP address if it is denied by the ACL.
+func Not(acl ACL) ACL {
+	return not{acl}
+}
+
+func (n not) Allowed(ip net.IP) bool {
+	return !n.acl.Allowed(ip)
+}
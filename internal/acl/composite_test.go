@@ -0,0 +1,71 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func newMaskOption(t *testing.T, cidr string) WhitelistOption {
+	option, err := NewOption(cidr)
+	require.NoError(t, err)
+	return option
+}
+
+func TestAllOfAllowsSubnetExceptBlacklistedRange(t *testing.T) {
+	// GIVEN
+	acl := AllOf(
+		NewWhitelist(newMaskOption(t, "10.1.0.0/16")),
+		NewBlacklist(newMaskOption(t, "10.1.13.0/24")))
+
+	// WHEN
+	allowInsideSubnet := acl.Allowed(net.IPv4(10, 1, 2, 3))
+	denyBlacklisted := acl.Allowed(net.IPv4(10, 1, 13, 7))
+	denyOutsideSubnet := acl.Allowed(net.IPv4(10, 2, 0, 1))
+
+	// THEN
+	assert.True(t, allowInsideSubnet)
+	assert.False(t, denyBlacklisted)
+	assert.False(t, denyOutsideSubnet)
+}
+
+func TestAnyOfAllowsAddressFromAnyList(t *testing.T) {
+	// GIVEN
+	acl := AnyOf(
+		NewWhitelist(WithIP(localhost)),
+		NewWhitelist(newMaskOption(t, "192.168.0.0/24")))
+
+	// WHEN
+	allowLocalhost := acl.Allowed(localhost)
+	allowSubnet := acl.Allowed(net.IPv4(192, 168, 0, 12))
+	denyOther := acl.Allowed(net.IPv4(192, 168, 1, 12))
+
+	// THEN
+	assert.True(t, allowLocalhost)
+	assert.True(t, allowSubnet)
+	assert.False(t, denyOther)
+}
+
+func TestNotInvertsDecision(t *testing.T) {
+	// GIVEN
+	acl := Not(NewWhitelist(WithIP(localhost)))
+
+	// WHEN
+	denyLocalhost := acl.Allowed(localhost)
+	allowOther := acl.Allowed(net.IPv4(127, 0, 0, 2))
+
+	// THEN
+	assert.False(t, denyLocalhost)
+	assert.True(t, allowOther)
+}
+
+func TestEmptyCombinators(t *testing.T) {
+	assert.True(t, AllOf().Allowed(localhost))
+	assert.False(t, AnyOf().Allowed(localhost))
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// File is a whitelist loaded from a file with one IP address or CIDR mask per line. Empty lines and comments starting
+// with '#' are ignored. Once Watch is called, the file is reloaded whenever its modification time or size changes.
+// A file that fails validation is rejected and the previously loaded whitelist remains in use.
+type File struct {
+	log  zerolog.Logger
+	path string
+
+	whitelist atomic.Pointer[Trie]
+
+	loadMu  sync.Mutex
+	modTime time.Time
+	size    int64
+
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewFile(log zerolog.Logger, path string) (*File, error) {
+	f := &File{
+		log:  log.With().Str("path", path).Logger(),
+		path: path,
+	}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Allowed(ip net.IP) bool {
+	return f.whitelist.Load().Allowed(ip)
+}
+
+// Reload reads the file and replaces the whitelist if all entries are valid.
+func (f *File) Reload() error {
+	f.loadMu.Lock()
+	defer f.loadMu.Unlock()
+
+	return f.load()
+}
+
+func (f *File) load() error {
+	info, statErr := os.Stat(f.path)
+	if statErr != nil {
+		return statErr
+	}
+
+	file, openErr := os.Open(f.path)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() { _ = file.Close() }()
+
+	prefixes, parseErr := ParseEntries(file)
+	if parseErr != nil {
+		return fmt.Errorf("%s: %w", f.path, parseErr)
+	}
+
+	f.whitelist.Store(NewTrie(prefixes...))
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.log.Info().Int("entries", len(prefixes)).Msg("load-acl")
+	return nil
+}
+
+// Watch polls the file for changes in the background until Close is called.
+func (f *File) Watch(interval time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.done != nil {
+		return
+	}
+
+	f.done = make(chan struct{})
+	f.wg.Add(1)
+	go func(done <-chan struct{}) {
+		defer f.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f.reloadIfChanged()
+			}
+		}
+	}(f.done)
+}
+
+func (f *File) reloadIfChanged() {
+	f.loadMu.Lock()
+	defer f.loadMu.Unlock()
+
+	info, statErr := os.Stat(f.path)
+	if statErr != nil {
+		f.log.Err(statErr).Msg("reload-acl")
+		return
+	}
+
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+
+	if reloadErr := f.load(); reloadErr != nil {
+		// remember the rejected version of the file to avoid logging the same error on every tick
+		f.modTime = info.ModTime()
+		f.size = info.Size()
+		f.log.Err(reloadErr).Msg("reload-acl")
+	}
+}
+
+// Close stops watching the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.done != nil {
+		close(f.done)
+		f.done = nil
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	return nil
+}
+
+// ParseEntries reads IP addresses and CIDR masks, one per line. Text following '#' is treated as a comment.
+func ParseEntries(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index >= 0 {
+			line = line[:index]
+		}
+		entry := strings.TrimSpace(line)
+		if entry == "" {
+			continue
+		}
+
+		prefix, prefixErr := ParsePrefix(entry)
+		if prefixErr != nil {
+			return nil, fmt.Errorf("%d: %w", lineNumber, prefixErr)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if scanErr := scanner.Err(); scanErr != nil {
+		return nil, scanErr
+	}
+
+	return prefixes, nil
+}
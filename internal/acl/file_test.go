@@ -0,0 +1,104 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeACLFile(t *testing.T, path, content string, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestParseEntriesSkipsComments(t *testing.T) {
+	// GIVEN
+	content := `
+# corporate network
+10.1.0.0/16
+127.0.0.1 # localhost
+`
+
+	// WHEN
+	prefixes, err := ParseEntries(strings.NewReader(content))
+
+	// THEN
+	require.NoError(t, err)
+	assert.Len(t, prefixes, 2)
+	acl := NewTrie(prefixes...)
+	assert.True(t, acl.Allowed(localhost))
+	assert.True(t, acl.Allowed(net.IPv4(10, 1, 2, 3)))
+	assert.False(t, acl.Allowed(net.IPv4(10, 2, 2, 3)))
+}
+
+func TestParseEntriesReportsLineNumber(t *testing.T) {
+	// GIVEN
+	content := "127.0.0.1\n\nlocalhost\n"
+
+	// WHEN
+	prefixes, err := ParseEntries(strings.NewReader(content))
+
+	// THEN
+	assert.EqualError(t, err, "3: invalid IP address: localhost")
+	assert.Nil(t, prefixes)
+}
+
+func TestFileKeepsPreviousListOnInvalidContent(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	modTime := time.Now().Add(-time.Hour)
+	writeACLFile(t, path, "127.0.0.1\n", modTime)
+	acl, loadErr := NewFile(zerolog.Nop(), path)
+	require.NoError(t, loadErr)
+
+	// WHEN
+	writeACLFile(t, path, "127.0.0.2\n127.0.0.300\n", modTime.Add(time.Second))
+	reloadErr := acl.Reload()
+
+	// THEN
+	assert.Error(t, reloadErr)
+	assert.True(t, acl.Allowed(localhost))
+	assert.False(t, acl.Allowed(net.IPv4(127, 0, 0, 2)))
+}
+
+func TestFileFailsToLoadMissingFile(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "missing.txt")
+
+	// WHEN
+	acl, err := NewFile(zerolog.Nop(), path)
+
+	// THEN
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Nil(t, acl)
+}
+
+func TestFileReloadsOnChange(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	modTime := time.Now().Add(-time.Hour)
+	writeACLFile(t, path, "127.0.0.1\n", modTime)
+	acl, loadErr := NewFile(zerolog.Nop(), path)
+	require.NoError(t, loadErr)
+	acl.Watch(10 * time.Millisecond)
+	defer func() { _ = acl.Close() }()
+
+	// WHEN
+	writeACLFile(t, path, "127.0.0.2\n", modTime.Add(time.Second))
+
+	// THEN
+	assert.Eventually(t, func() bool {
+		return acl.Allowed(net.IPv4(127, 0, 0, 2)) && !acl.Allowed(localhost)
+	}, time.Second, 10*time.Millisecond)
+}
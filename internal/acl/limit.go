@@ -0,0 +1,259 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// sweepInterval is the number of connection attempts after which idle client entries are removed
+const sweepInterval = 1024
+
+type LimitOptions struct {
+	maxConns      int
+	maxConnsPerIP int
+	acceptRate    rate.Limit
+	acceptBurst   int
+}
+
+type LimitOption func(options *LimitOptions)
+
+// WithMaxConns caps the number of concurrent connections accepted by the listener.
+func WithMaxConns(maxConns int) LimitOption {
+	return func(opts *LimitOptions) {
+		opts.maxConns = maxConns
+	}
+}
+
+// WithMaxConnsPerIP caps the number of concurrent connections accepted from a single IP address.
+func WithMaxConnsPerIP(maxConns int) LimitOption {
+	return func(opts *LimitOptions) {
+		opts.maxConnsPerIP = maxConns
+	}
+}
+
+// WithAcceptRate limits the rate of new connections accepted from a single IP address.
+func WithAcceptRate(limit rate.Limit, burst int) LimitOption {
+	return func(opts *LimitOptions) {
+		opts.acceptRate = limit
+		opts.acceptBurst = burst
+	}
+}
+
+type LimitStats struct {
+	Active             int
+	RejectedTotal      uint64
+	RejectedPerIP      uint64
+	RejectedAcceptRate uint64
+}
+
+type clientLimit struct {
+	conns   int
+	limiter *rate.Limiter
+}
+
+// Limiter counts connections against the global and per-client limits. A limiter shared by several listeners applies
+// the limits to their connections together.
+type Limiter struct {
+	options LimitOptions
+
+	mu       sync.Mutex
+	active   int
+	clients  map[string]*clientLimit
+	attempts int
+
+	rejectedTotal      atomic.Uint64
+	rejectedPerIP      atomic.Uint64
+	rejectedAcceptRate atomic.Uint64
+}
+
+func NewLimiter(opts ...LimitOption) *Limiter {
+	var options LimitOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.acceptRate > 0 && options.acceptBurst < 1 {
+		options.acceptBurst = 1
+	}
+
+	return &Limiter{
+		options: options,
+		clients: make(map[string]*clientLimit),
+	}
+}
+
+// WrapListener returns the listener closing connections that exceed limits counted by the limiter.
+func (l *Limiter) WrapListener(log zerolog.Logger, listener net.Listener) *LimitListener {
+	return &LimitListener{
+		log:      log,
+		listener: listener,
+		limiter:  l,
+	}
+}
+
+// LimitListener closes connections exceeding the global or per-client limits and resumes listening.
+type LimitListener struct {
+	log      zerolog.Logger
+	listener net.Listener
+	limiter  *Limiter
+}
+
+// WrapLimitListener returns the listener with its own limiter, so limits apply to connections of this listener only.
+func WrapLimitListener(log zerolog.Logger, listener net.Listener, opts ...LimitOption) *LimitListener {
+	return NewLimiter(opts...).WrapListener(log, listener)
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, acceptErr := l.listener.Accept()
+		if acceptErr != nil {
+			return nil, acceptErr
+		}
+
+		ip, lookupErr := netConnLookup(conn)
+		if lookupErr != nil {
+			l.closeConn(conn, ip)
+			return nil, lookupErr
+		}
+
+		reason := l.limiter.acquire(ip)
+		if reason == "" {
+			return &limitedConn{Conn: conn, l: l.limiter, ip: ip.String()}, nil
+		}
+
+		// the limit is exceeded, close the connection and resume listening
+		l.log.Info().IPAddr("remoteAddr", ip).Str("reason", reason).Msg("limit-connection")
+		l.closeConn(conn, ip)
+	}
+}
+
+func (l *Limiter) acquire(ip net.IP) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.attempts++
+	if l.attempts%sweepInterval == 0 {
+		l.sweep()
+	}
+
+	key := ip.String()
+	client := l.clients[key]
+	if client == nil {
+		client = &clientLimit{}
+		if l.options.acceptRate > 0 {
+			client.limiter = rate.NewLimiter(l.options.acceptRate, l.options.acceptBurst)
+		}
+		l.clients[key] = client
+	}
+
+	if l.options.maxConns > 0 && l.active >= l.options.maxConns {
+		l.rejectedTotal.Add(1)
+		return "max-conns"
+	}
+
+	if l.options.maxConnsPerIP > 0 && client.conns >= l.options.maxConnsPerIP {
+		l.rejectedPerIP.Add(1)
+		return "max-conns-per-ip"
+	}
+
+	if client.limiter != nil && !client.limiter.Allow() {
+		l.rejectedAcceptRate.Add(1)
+		return "accept-rate"
+	}
+
+	client.conns++
+	l.active++
+	return ""
+}
+
+func (l *Limiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if client, ok := l.clients[key]; ok {
+		client.conns--
+		if client.idle(l.options.acceptBurst) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// sweep removes entries of clients that have no open connections and whose rate limiters are full
+func (l *Limiter) sweep() {
+	for key, client := range l.clients {
+		if client.idle(l.options.acceptBurst) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+func (c *clientLimit) idle(burst int) bool {
+	if c.conns > 0 {
+		return false
+	}
+	return c.limiter == nil || c.limiter.Tokens() >= float64(burst)
+}
+
+func (l *LimitListener) Stats() LimitStats {
+	return l.limiter.Stats()
+}
+
+func (l *Limiter) Stats() LimitStats {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+
+	return LimitStats{
+		Active:             active,
+		RejectedTotal:      l.rejectedTotal.Load(),
+		RejectedPerIP:      l.rejectedPerIP.Load(),
+		RejectedAcceptRate: l.rejectedAcceptRate.Load(),
+	}
+}
+
+func (l *LimitListener) closeConn(conn net.Conn, ip net.IP) {
+	if closeErr := conn.Close(); closeErr != nil {
+		event := l.log.Err(closeErr)
+		if !ip.IsUnspecified() {
+			event.IPAddr("remoteAddr", ip)
+		}
+		event.Msg("close-network-connection")
+	}
+}
+
+func (l *LimitListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *LimitListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+type limitedConn struct {
+	net.Conn
+	l    *Limiter
+	ip   string
+	once sync.Once
+}
+
+// NetConn returns the connection accepted by the wrapped listener
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.l.release(c.ip)
+	})
+	return err
+}
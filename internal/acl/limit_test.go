@@ -0,0 +1,147 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+var errStopListener = errors.New("listener: stop")
+
+func newMockClientConn(remoteAddr string) *mockConn {
+	addr := new(mockAddr)
+	addr.On("String").Return(remoteAddr)
+	conn := new(mockConn)
+	conn.On("RemoteAddr").Return(addr)
+	conn.On("Close").Return(nil)
+	return conn
+}
+
+func newMockListener(conns ...net.Conn) *mockListener {
+	listener := new(mockListener)
+	for _, conn := range conns {
+		listener.On("Accept").Return(conn, nil).Once()
+	}
+	listener.On("Accept").Return(nil, errStopListener)
+	return listener
+}
+
+func TestLimitsConnectionsPerIP(t *testing.T) {
+	// GIVEN
+	first := newMockClientConn("10.0.0.1:1000")
+	second := newMockClientConn("10.0.0.1:1001")
+	other := newMockClientConn("10.0.0.2:1000")
+	listener := WrapLimitListener(zerolog.Nop(), newMockListener(first, second, other), WithMaxConnsPerIP(1))
+
+	// WHEN
+	firstConn, firstErr := listener.Accept()
+	otherConn, otherErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, firstErr)
+	require.NoError(t, otherErr)
+	assert.Equal(t, first, firstConn.(*limitedConn).Conn)
+	assert.Equal(t, other, otherConn.(*limitedConn).Conn)
+	second.AssertCalled(t, "Close")
+	assert.Equal(t, LimitStats{Active: 2, RejectedPerIP: 1}, listener.Stats())
+}
+
+func TestSharesLimiterBetweenListeners(t *testing.T) {
+	// GIVEN
+	first := newMockClientConn("10.0.0.1:1000")
+	second := newMockClientConn("10.0.0.1:1001")
+	limiter := NewLimiter(WithMaxConnsPerIP(1))
+	httpListener := limiter.WrapListener(zerolog.Nop(), newMockListener(first))
+	socksListener := limiter.WrapListener(zerolog.Nop(), newMockListener(second))
+
+	// WHEN
+	_, firstErr := httpListener.Accept()
+	_, secondErr := socksListener.Accept()
+
+	// THEN
+	require.NoError(t, firstErr)
+	assert.ErrorIs(t, secondErr, errStopListener)
+	second.AssertCalled(t, "Close")
+	assert.Equal(t, LimitStats{Active: 1, RejectedPerIP: 1}, limiter.Stats())
+}
+
+func TestReleasesConnectionOnClose(t *testing.T) {
+	// GIVEN
+	first := newMockClientConn("10.0.0.1:1000")
+	second := newMockClientConn("10.0.0.1:1001")
+	listener := WrapLimitListener(zerolog.Nop(), newMockListener(first, second), WithMaxConnsPerIP(1))
+	firstConn, firstErr := listener.Accept()
+	require.NoError(t, firstErr)
+
+	// WHEN
+	assert.NoError(t, firstConn.Close())
+	assert.NoError(t, firstConn.Close())
+	secondConn, secondErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, secondErr)
+	assert.Equal(t, second, secondConn.(*limitedConn).Conn)
+	assert.Equal(t, LimitStats{Active: 1}, listener.Stats())
+}
+
+func TestLimitsTotalConnections(t *testing.T) {
+	// GIVEN
+	first := newMockClientConn("10.0.0.1:1000")
+	second := newMockClientConn("10.0.0.2:1000")
+	listener := WrapLimitListener(zerolog.Nop(), newMockListener(first, second), WithMaxConns(1))
+
+	// WHEN
+	_, firstErr := listener.Accept()
+	secondConn, secondErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, firstErr)
+	assert.Nil(t, secondConn)
+	assert.ErrorIs(t, secondErr, errStopListener)
+	second.AssertCalled(t, "Close")
+	assert.Equal(t, LimitStats{Active: 1, RejectedTotal: 1}, listener.Stats())
+}
+
+func TestLimitsAcceptRatePerIP(t *testing.T) {
+	// GIVEN
+	first := newMockClientConn("10.0.0.1:1000")
+	second := newMockClientConn("10.0.0.1:1001")
+	listener := WrapLimitListener(zerolog.Nop(), newMockListener(first, second), WithAcceptRate(0.001, 1))
+
+	// WHEN
+	firstConn, firstErr := listener.Accept()
+	require.NoError(t, firstErr)
+	require.NoError(t, firstConn.Close())
+	secondConn, secondErr := listener.Accept()
+
+	// THEN
+	assert.Nil(t, secondConn)
+	assert.ErrorIs(t, secondErr, errStopListener)
+	second.AssertCalled(t, "Close")
+	assert.Equal(t, LimitStats{RejectedAcceptRate: 1}, listener.Stats())
+}
+
+func TestComposesWithACLListener(t *testing.T) {
+	// GIVEN
+	blocked := newMockClientConn("10.0.0.1:1000")
+	allowed := newMockClientConn("127.0.0.1:1000")
+	aclListener := WrapListener(zerolog.Nop(), NewWhitelist(WithIP(localhost)), newMockListener(blocked, allowed))
+	listener := WrapLimitListener(zerolog.Nop(), aclListener, WithMaxConnsPerIP(1))
+
+	// WHEN
+	conn, err := listener.Accept()
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, allowed, conn.(*limitedConn).Conn)
+	blocked.AssertCalled(t, "Close")
+	assert.Equal(t, LimitStats{Active: 1}, listener.Stats())
+}
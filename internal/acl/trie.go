@@ -0,0 +1,147 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Trie is a whitelist of network prefixes stored in a binary trie. The cost of a lookup is proportional to the length
+// of the address rather than to the number of prefixes. IPv4-mapped IPv6 addresses and prefixes are treated as IPv4.
+type Trie struct {
+	v4   trieNode
+	v6   trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+func NewTrie(prefixes ...netip.Prefix) *Trie {
+	t := &Trie{}
+	for _, prefix := range prefixes {
+		t.Insert(prefix)
+	}
+	return t
+}
+
+// ParsePrefix parses an IP address or a CIDR mask. An IP address is converted to a single-address prefix. IPv6
+// addresses with a zone are rejected, because the zone can't be part of a prefix. IPv4-mapped prefixes shorter than
+// /96 are rejected as well, because they mix IPv4 and IPv6 addresses.
+func ParsePrefix(entry string) (netip.Prefix, error) {
+	isIp := strings.IndexByte(entry, '/') < 0
+	if isIp {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil || addr.Zone() != "" {
+			return netip.Prefix{}, &net.ParseError{Type: "IP address", Text: entry}
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil || prefix.Addr().Is4In6() && prefix.Bits() < 96 {
+		return netip.Prefix{}, &net.ParseError{Type: "CIDR address", Text: entry}
+	}
+	return prefix, nil
+}
+
+// Insert adds the prefix to the trie. An IPv4-mapped prefix shorter than /96 covers the whole IPv4-mapped range, so
+// it matches all IPv4 addresses in addition to IPv6 addresses outside the range.
+func (t *Trie) Insert(prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() {
+		if bits < 96 {
+			t.insert(&t.v4, nil, 0)
+			t.insert(&t.v6, addr.AsSlice(), bits)
+			return
+		}
+		addr, bits = addr.Unmap(), bits-96
+	}
+
+	if addr.Is4() {
+		t.insert(&t.v4, addr.AsSlice(), bits)
+	} else {
+		t.insert(&t.v6, addr.AsSlice(), bits)
+	}
+}
+
+func (t *Trie) insert(root *trieNode, key []byte, bits int) {
+	n := root
+	for i := 0; i < bits; i++ {
+		if n.terminal {
+			// a shorter prefix already covers the inserted one
+			return
+		}
+
+		bit := key[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &trieNode{}
+		}
+		n = n.children[bit]
+	}
+
+	if !n.terminal {
+		// longer prefixes stored in the subtree are covered by the inserted one
+		t.size -= n.count()
+		n.terminal = true
+		n.children = [2]*trieNode{}
+		t.size++
+	}
+}
+
+func (n *trieNode) count() int {
+	if n == nil {
+		return 0
+	}
+	if n.terminal {
+		return 1
+	}
+	return n.children[0].count() + n.children[1].count()
+}
+
+// Len returns the number of prefixes stored in the trie excluding prefixes covered by shorter ones.
+func (t *Trie) Len() int {
+	return t.size
+}
+
+func (t *Trie) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	n := &t.v6
+	if addr.Is4() {
+		n = &t.v4
+	}
+
+	key := addr.AsSlice()
+	for i := 0; i < len(key)*8; i++ {
+		if n.terminal {
+			return true
+		}
+
+		n = n.children[key[i/8]>>(7-i%8)&1]
+		if n == nil {
+			return false
+		}
+	}
+
+	return n.terminal
+}
+
+func (t *Trie) Allowed(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return t.Contains(addr)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package acl
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func mustParsePrefixes(t testing.TB, entries ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		prefix, err := ParsePrefix(entry)
+		require.NoError(t, err)
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func TestCreateEmptyTrie(t *testing.T) {
+	// GIVEN
+	acl := NewTrie()
+
+	// WHEN
+	allowed := acl.Allowed(localhost)
+
+	// THEN
+	assert.False(t, allowed)
+	assert.Equal(t, 0, acl.Len())
+}
+
+func TestTrieMatchesIPv4(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(mustParsePrefixes(t, "127.0.0.1", "10.1.0.0/16", "192.168.1.130/25")...)
+
+	// WHEN-THEN
+	assert.True(t, acl.Allowed(localhost))
+	assert.False(t, acl.Allowed(net.IPv4(127, 0, 0, 2)))
+	assert.True(t, acl.Allowed(net.IPv4(10, 1, 255, 255)))
+	assert.False(t, acl.Allowed(net.IPv4(10, 2, 0, 0)))
+	assert.True(t, acl.Allowed(net.IPv4(192, 168, 1, 200)))
+	assert.False(t, acl.Allowed(net.IPv4(192, 168, 1, 127)))
+}
+
+func TestTrieMatchesIPv6(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(mustParsePrefixes(t, "::1", "2001:db8::/32")...)
+
+	// WHEN-THEN
+	assert.True(t, acl.Allowed(net.IPv6loopback))
+	assert.True(t, acl.Allowed(net.ParseIP("2001:db8:1::1")))
+	assert.False(t, acl.Allowed(net.ParseIP("2001:db9::1")))
+	assert.False(t, acl.Allowed(localhost))
+}
+
+func TestTrieMatchesIPv4MappedAddresses(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(mustParsePrefixes(t, "::ffff:10.0.0.0/104", "192.168.0.1")...)
+
+	// WHEN-THEN
+	assert.True(t, acl.Allowed(net.IPv4(10, 20, 30, 40)))
+	assert.True(t, acl.Allowed(net.ParseIP("::ffff:10.20.30.40")))
+	assert.True(t, acl.Contains(netip.MustParseAddr("::ffff:192.168.0.1")))
+	assert.True(t, acl.Contains(netip.MustParseAddr("192.168.0.1")))
+	assert.False(t, acl.Allowed(net.ParseIP("::10.20.30.40")))
+}
+
+func TestTrieMatchesShortIPv4MappedPrefixes(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(netip.MustParsePrefix("::ffff:0:0/80"))
+
+	// WHEN-THEN
+	assert.True(t, acl.Allowed(net.IPv4(10, 20, 30, 40)))
+	assert.True(t, acl.Allowed(net.ParseIP("::ffff:10.20.30.40")))
+	assert.True(t, acl.Allowed(net.ParseIP("::1")))
+	assert.False(t, acl.Allowed(net.ParseIP("::1:0:0:1")))
+}
+
+func TestTrieIgnoresCoveredPrefixes(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(mustParsePrefixes(t, "10.1.2.0/24", "10.0.0.0/8", "10.1.0.0/16")...)
+
+	// WHEN-THEN
+	assert.Equal(t, 1, acl.Len())
+	assert.True(t, acl.Allowed(net.IPv4(10, 200, 0, 1)))
+}
+
+func TestTrieRejectsInvalidAddress(t *testing.T) {
+	// GIVEN
+	acl := NewTrie(mustParsePrefixes(t, "0.0.0.0/0")...)
+
+	// WHEN-THEN
+	assert.False(t, acl.Allowed(nil))
+	assert.True(t, acl.Allowed(localhost))
+}
+
+func TestParsePrefixErrors(t *testing.T) {
+	_, ipErr := ParsePrefix("localhost")
+	assert.EqualError(t, ipErr, "invalid IP address: localhost")
+
+	_, maskErr := ParsePrefix("10.0.0.0/33")
+	assert.EqualError(t, maskErr, "invalid CIDR address: 10.0.0.0/33")
+
+	_, zoneErr := ParsePrefix("fe80::1%eth0")
+	assert.EqualError(t, zoneErr, "invalid IP address: fe80::1%eth0")
+
+	_, zonedMaskErr := ParsePrefix("fe80::1%eth0/64")
+	assert.EqualError(t, zonedMaskErr, "invalid CIDR address: fe80::1%eth0/64")
+
+	_, mappedMaskErr := ParsePrefix("::ffff:10.0.0.0/80")
+	assert.EqualError(t, mappedMaskErr, "invalid CIDR address: ::ffff:10.0.0.0/80")
+}
+
+const benchmarkPrefixes = 5000
+
+func newBenchmarkRanges() ([]string, []net.IP) {
+	random := rand.New(rand.NewSource(1))
+	ranges := make([]string, 0, benchmarkPrefixes)
+	for i := 0; i < benchmarkPrefixes; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, random.Uint32())
+		ranges = append(ranges, (&net.IPNet{IP: ip, Mask: net.CIDRMask(16+random.Intn(13), 32)}).String())
+	}
+
+	ips := make([]net.IP, 0, 1024)
+	for i := 0; i < cap(ips); i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, random.Uint32())
+		ips = append(ips, ip.To16())
+	}
+	return ranges, ips
+}
+
+func BenchmarkWhitelistAllowed(b *testing.B) {
+	ranges, ips := newBenchmarkRanges()
+	options := make([]WhitelistOption, 0, len(ranges))
+	for _, entry := range ranges {
+		option, err := NewOption(entry)
+		require.NoError(b, err)
+		options = append(options, option)
+	}
+	acl := NewWhitelist(options...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acl.Allowed(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkTrieAllowed(b *testing.B) {
+	ranges, ips := newBenchmarkRanges()
+	acl := NewTrie(mustParsePrefixes(b, ranges...)...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acl.Allowed(ips[i%len(ips)])
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package netutil
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"net"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// AcceptLoop passes connections accepted by the listener to the handler until the listener is closed, in which case
+// net.ErrClosed is returned. Other errors, e.g., running out of file descriptors, are retried with the backoff, as in
+// net/http, because returning them would stop the server for good. The wait is interrupted once closed is closed.
+func AcceptLoop(log zerolog.Logger, listener net.Listener, closed <-chan struct{}, handle func(conn net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			if errors.Is(acceptErr, net.ErrClosed) {
+				return acceptErr
+			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Info().Err(acceptErr).Dur("retryDelay", delay).Msg("accept")
+			select {
+			case <-time.After(delay):
+				continue
+			case <-closed:
+				return net.ErrClosed
+			}
+		}
+
+		delay = 0
+		handle(conn)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package netutil
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// flakyListener returns the errors from the first Accept calls and then accepts connections of the listener
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptLoopRetriesErrors(t *testing.T) {
+	// GIVEN
+	tcpListener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	enfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.ENFILE}
+	listener := &flakyListener{Listener: tcpListener, errs: []error{emfile, enfile}}
+	clientConn, dialErr := net.Dial("tcp4", tcpListener.Addr().String())
+	require.NoError(t, dialErr)
+	defer func() { _ = clientConn.Close() }()
+
+	// WHEN
+	var accepted int
+	loopErr := AcceptLoop(zerolog.Nop(), listener, nil, func(conn net.Conn) {
+		accepted += 1
+		_ = conn.Close()
+		_ = tcpListener.Close()
+	})
+
+	// THEN
+	assert.ErrorIs(t, loopErr, net.ErrClosed)
+	assert.Equal(t, 1, accepted)
+}
+
+func TestAcceptLoopStopsWaitingOnceClosed(t *testing.T) {
+	// GIVEN
+	tcpListener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	defer func() { _ = tcpListener.Close() }()
+	listener := &flakyListener{Listener: tcpListener, errs: []error{&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}}}
+	closed := make(chan struct{})
+	close(closed)
+
+	// WHEN
+	loopErr := AcceptLoop(zerolog.Nop(), listener, closed, func(conn net.Conn) {})
+
+	// THEN
+	assert.ErrorIs(t, loopErr, net.ErrClosed)
+}
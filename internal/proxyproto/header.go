@@ -0,0 +1,183 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2Length    = 16
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+)
+
+type Command uint8
+
+const (
+	// LocalCommand is sent by the proxy on its own behalf, e.g., for health checks. The connection endpoints are used.
+	LocalCommand Command = iota
+	// ProxyCommand is sent on behalf of another node. The header contains the addresses of the original connection.
+	ProxyCommand
+)
+
+type Header struct {
+	Version     int
+	Command     Command
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader reads the PROXY protocol header in the version 1 (text) or 2 (binary) format.
+// Source and Destination are nil if the header doesn't carry addresses, i.e., for LOCAL commands and UNKNOWN or UNSPEC
+// address families.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	prefix, peekErr := r.Peek(len(v1Prefix))
+	if peekErr != nil {
+		return nil, peekErr
+	}
+
+	if string(prefix) == v1Prefix {
+		return readV1(r)
+	}
+
+	if prefix, peekErr = r.Peek(len(v2Signature)); peekErr != nil {
+		return nil, peekErr
+	}
+
+	if bytes.Equal(prefix, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, readErr := r.ReadByte()
+		if readErr != nil {
+			return nil, readErr
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: missing CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: missing protocol", ErrInvalidHeader)
+	}
+
+	header := &Header{Version: 1, Command: ProxyCommand}
+	switch fields[1] {
+	case "UNKNOWN":
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol %q", ErrInvalidHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: expected 6 fields, got %d", ErrInvalidHeader, len(fields))
+	}
+
+	var parseErr error
+	if header.Source, parseErr = parseV1Addr(fields[1], fields[2], fields[4]); parseErr != nil {
+		return nil, parseErr
+	}
+	if header.Destination, parseErr = parseV1Addr(fields[1], fields[3], fields[5]); parseErr != nil {
+		return nil, parseErr
+	}
+	return header, nil
+}
+
+func parseV1Addr(protocol, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (protocol == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: invalid %s address %q", ErrInvalidHeader, protocol, host)
+	}
+
+	portNumber, portErr := strconv.ParseUint(port, 10, 16)
+	if portErr != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidHeader, port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2Length)
+	if _, readErr := io.ReadFull(r, fixed); readErr != nil {
+		return nil, readErr
+	}
+
+	versionCommand, family := fixed[12], fixed[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, readErr := io.ReadFull(r, payload); readErr != nil {
+		return nil, readErr
+	}
+
+	header := &Header{Version: 2}
+	switch versionCommand & 0x0F {
+	case 0x00:
+		header.Command = LocalCommand
+		return header, nil
+	case 0x01:
+		header.Command = ProxyCommand
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, versionCommand&0x0F)
+	}
+
+	// only the stream transport is relevant for a TCP listener, other transports are treated as UNSPEC
+	var ipLength int
+	switch family {
+	case 0x11:
+		ipLength = net.IPv4len
+	case 0x21:
+		ipLength = net.IPv6len
+	default:
+		return header, nil
+	}
+
+	if len(payload) < 2*ipLength+4 {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidHeader)
+	}
+
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[:ipLength])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[ipLength : 2*ipLength])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+	}
+	return header, nil
+}
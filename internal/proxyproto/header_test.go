@@ -0,0 +1,150 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadV1TCP4Header(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, 1, header.Version)
+	assert.Equal(t, ProxyCommand, header.Command)
+	assert.Equal(t, "192.168.0.1:56324", header.Source.String())
+	assert.Equal(t, "10.0.0.1:443", header.Destination.String())
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+}
+
+func TestReadV1TCP6Header(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\n"))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1000", header.Source.String())
+	assert.Equal(t, "[2001:db8::2]:2000", header.Destination.String())
+}
+
+func TestReadV1UnknownHeader(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Nil(t, header.Source)
+}
+
+func TestReadInvalidV1Header(t *testing.T) {
+	for _, text := range []string{
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 70000\r\n",
+		"PROXY UDP4 192.168.0.1 10.0.0.1 56324 443\r\n",
+		"PROXY " + strings.Repeat("A", 200),
+	} {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(text)))
+		assert.ErrorIs(t, err, ErrInvalidHeader, text)
+	}
+}
+
+func TestReadV2TCP4Header(t *testing.T) {
+	// GIVEN
+	payload := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x01, 0xBB}
+	payload = append(payload, 0x04, 0x00, 0x01, 0xFF) // TLV ignored by the parser
+	data := append(newV2Header(0x01, 0x11, payload), []byte("payload")...)
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, ProxyCommand, header.Command)
+	assert.Equal(t, "192.168.0.1:56324", header.Source.String())
+	assert.Equal(t, "10.0.0.1:443", header.Destination.String())
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "payload", string(rest))
+}
+
+func TestReadV2TCP6Header(t *testing.T) {
+	// GIVEN
+	payload := append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...)
+	payload = append(payload, 0x03, 0xE8, 0x07, 0xD0)
+	r := bufio.NewReader(bytes.NewReader(newV2Header(0x01, 0x21, payload)))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1000", header.Source.String())
+	assert.Equal(t, "[2001:db8::2]:2000", header.Destination.String())
+}
+
+func TestReadV2LocalHeader(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(bytes.NewReader(newV2Header(0x00, 0x00, nil)))
+
+	// WHEN
+	header, err := ReadHeader(r)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, LocalCommand, header.Command)
+	assert.Nil(t, header.Source)
+}
+
+func TestReadV2TruncatedAddress(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(bytes.NewReader(newV2Header(0x01, 0x11, []byte{192, 168, 0, 1})))
+
+	// WHEN
+	_, err := ReadHeader(r)
+
+	// THEN
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestReadMissingHeader(t *testing.T) {
+	// GIVEN
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	// WHEN
+	_, err := ReadHeader(r)
+
+	// THEN
+	assert.ErrorIs(t, err, ErrNoHeader)
+}
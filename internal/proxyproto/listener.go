@@ -0,0 +1,182 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxyproto
+
+import (
+	"bufio"
+	"github.com/pmateusz/glove/internal/acl"
+	"github.com/pmateusz/glove/internal/netutil"
+	"github.com/rs/zerolog"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultHeaderTimeout = 5 * time.Second
+
+// Conn is a connection accepted from a trusted proxy. RemoteAddr returns the address of the client passed in the
+// PROXY protocol header, whereas ProxyAddr returns the address of the proxy that opened the connection.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the connection opened by the proxy
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type ListenerOptions struct {
+	headerTimeout time.Duration
+}
+
+type ListenerOption func(options *ListenerOptions)
+
+// WithHeaderTimeout sets the deadline for receiving the PROXY protocol header after the connection is accepted.
+func WithHeaderTimeout(timeout time.Duration) ListenerOption {
+	return func(opts *ListenerOptions) {
+		opts.headerTimeout = timeout
+	}
+}
+
+// Listener reads the PROXY protocol header from connections accepted from trusted sources and rewrites their remote
+// addresses. Connections from other sources are returned unchanged. Headers are read in the background, so a slow
+// client doesn't stall accepting other connections.
+type Listener struct {
+	log      zerolog.Logger
+	listener net.Listener
+	trusted  acl.ACL
+	options  ListenerOptions
+
+	start     sync.Once
+	conns     chan net.Conn
+	done      chan struct{}
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func WrapListener(log zerolog.Logger, trusted acl.ACL, listener net.Listener, opts ...ListenerOption) *Listener {
+	options := ListenerOptions{headerTimeout: defaultHeaderTimeout}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Listener{
+		log:      log,
+		listener: listener,
+		trusted:  trusted,
+		options:  options,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop stops only once the listener is closed, other errors are retried
+func (l *Listener) acceptLoop() {
+	l.err = netutil.AcceptLoop(l.log, l.listener, l.closed, func(conn net.Conn) {
+		go l.handshake(conn)
+	})
+	close(l.done)
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	ip, lookupErr := remoteIP(conn)
+	if lookupErr != nil || !l.trusted.Allowed(ip) {
+		l.deliver(conn)
+		return
+	}
+
+	if deadlineErr := conn.SetReadDeadline(time.Now().Add(l.options.headerTimeout)); deadlineErr != nil {
+		l.reject(conn, ip, deadlineErr)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	header, headerErr := ReadHeader(reader)
+	if headerErr != nil {
+		l.reject(conn, ip, headerErr)
+		return
+	}
+
+	if deadlineErr := conn.SetReadDeadline(time.Time{}); deadlineErr != nil {
+		l.reject(conn, ip, deadlineErr)
+		return
+	}
+
+	proxyConn := &Conn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr()}
+	if header.Command == ProxyCommand && header.Source != nil {
+		proxyConn.remoteAddr = header.Source
+	}
+	l.deliver(proxyConn)
+}
+
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+func (l *Listener) reject(conn net.Conn, ip net.IP, err error) {
+	l.log.Info().IPAddr("proxyAddr", ip).Err(err).Msg("read-proxy-header")
+	if closeErr := conn.Close(); closeErr != nil {
+		l.log.Err(closeErr).IPAddr("proxyAddr", ip).Msg("close-network-connection")
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.listener.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func remoteIP(conn net.Conn) (net.IP, error) {
+	remoteAddr := conn.RemoteAddr()
+	if remoteAddr == nil {
+		return nil, acl.ErrNoRemoteAddress
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ParseIP(host), nil
+}
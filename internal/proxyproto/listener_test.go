@@ -0,0 +1,142 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxyproto
+
+import (
+	"github.com/pmateusz/glove/internal/acl"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestListener(t *testing.T, trusted acl.ACL, opts ...ListenerOption) *Listener {
+	tcpListener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	listener := WrapListener(zerolog.Nop(), trusted, tcpListener, opts...)
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+func dialAndWrite(t *testing.T, listener net.Listener, content string) net.Conn {
+	conn, dialErr := net.Dial("tcp4", listener.Addr().String())
+	require.NoError(t, dialErr)
+	t.Cleanup(func() { _ = conn.Close() })
+	_, writeErr := conn.Write([]byte(content))
+	require.NoError(t, writeErr)
+	return conn
+}
+
+func TestRewritesRemoteAddressOfTrustedProxy(t *testing.T) {
+	// GIVEN
+	listener := newTestListener(t, acl.NewWhitelist(acl.WithIP(net.IPv4(127, 0, 0, 1))))
+	clientConn := dialAndWrite(t, listener, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello")
+
+	// WHEN
+	conn, acceptErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, acceptErr)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+	assert.Equal(t, clientConn.LocalAddr().String(), conn.(*Conn).ProxyAddr().String())
+	buffer := make([]byte, 5)
+	_, readErr := io.ReadFull(conn, buffer)
+	require.NoError(t, readErr)
+	assert.Equal(t, "hello", string(buffer))
+}
+
+func TestKeepsConnectionsOfUntrustedSources(t *testing.T) {
+	// GIVEN
+	listener := newTestListener(t, acl.NewWhitelist())
+	clientConn := dialAndWrite(t, listener, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")
+
+	// WHEN
+	conn, acceptErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, acceptErr)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, clientConn.LocalAddr().String(), conn.RemoteAddr().String())
+	buffer := make([]byte, 6)
+	_, readErr := io.ReadFull(conn, buffer)
+	require.NoError(t, readErr)
+	assert.Equal(t, "PROXY ", string(buffer))
+}
+
+func TestRejectsTrustedConnectionWithoutHeader(t *testing.T) {
+	// GIVEN
+	listener := newTestListener(t, acl.NewWhitelist(acl.WithIP(net.IPv4(127, 0, 0, 1))),
+		WithHeaderTimeout(50*time.Millisecond))
+	rejectedConn := dialAndWrite(t, listener, "GET / HTTP/1.1\r\n\r\n")
+	slowConn := dialAndWrite(t, listener, "")
+	dialAndWrite(t, listener, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")
+
+	// WHEN
+	conn, acceptErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, acceptErr)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+	for _, closedConn := range []net.Conn{rejectedConn, slowConn} {
+		require.NoError(t, closedConn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, readErr := closedConn.Read(make([]byte, 1))
+		assert.ErrorIs(t, readErr, io.EOF)
+	}
+}
+
+func TestReturnsAcceptErrorAfterClose(t *testing.T) {
+	// GIVEN
+	listener := newTestListener(t, acl.NewWhitelist())
+
+	// WHEN
+	require.NoError(t, listener.Close())
+	conn, acceptErr := listener.Accept()
+
+	// THEN
+	assert.Nil(t, conn)
+	assert.ErrorIs(t, acceptErr, net.ErrClosed)
+}
+
+// flakyListener returns the error from the first Accept call and then accepts connections of the listener
+type flakyListener struct {
+	net.Listener
+	err error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if err := l.err; err != nil {
+		l.err = nil
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestRetriesTemporaryAcceptError(t *testing.T) {
+	// GIVEN
+	tcpListener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	flaky := &flakyListener{Listener: tcpListener, err: &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}}
+	listener := WrapListener(zerolog.Nop(), acl.NewWhitelist(), flaky)
+	t.Cleanup(func() { _ = listener.Close() })
+	dialAndWrite(t, listener, "hello")
+
+	// WHEN
+	conn, acceptErr := listener.Accept()
+
+	// THEN
+	require.NoError(t, acceptErr)
+	defer func() { _ = conn.Close() }()
+	buffer := make([]byte, 5)
+	_, readErr := io.ReadFull(conn, buffer)
+	assert.NoError(t, readErr)
+	assert.Equal(t, "hello", string(buffer))
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package urllib
+
+import (
+	"github.com/pmateusz/glove/internal/acl"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var untrusted = acl.NewWhitelist()
+
+// ClientIP returns the remote address of the request. Forwarding headers are ignored, because no proxy is trusted.
+// Use ClientIPResolver to accept forwarding headers from trusted proxies.
+func ClientIP(r *http.Request) net.IP {
+	return NewClientIPResolver(untrusted).ClientIP(r)
+}
+
+// ClientIPResolver finds the address of the client that sent a request through a chain of trusted proxies.
+type ClientIPResolver struct {
+	trusted acl.ACL
+}
+
+func NewClientIPResolver(trusted acl.ACL) *ClientIPResolver {
+	if trusted == nil {
+		trusted = untrusted
+	}
+	return &ClientIPResolver{trusted: trusted}
+}
+
+// ClientIP walks the chain of addresses from the Forwarded header (RFC 7239) or the X-Forwarded-For header from the
+// right and returns the first address that doesn't belong to a trusted proxy. The chain is considered only if the
+// request was received from a trusted proxy. If the hop preceding a trusted proxy is unknown or obfuscated, the address
+// of the trusted proxy is returned. X-Real-IP is used if the request doesn't have any of the former headers.
+func (c *ClientIPResolver) ClientIP(r *http.Request) net.IP {
+	ip := RemoteIp(r)
+	if ip == nil || !c.trusted.Allowed(ip) {
+		return ip
+	}
+
+	var chain []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		chain = parseForwarded(values)
+	} else if values = r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		chain = parseList(values)
+	} else if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		chain = []string{realIP}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !c.trusted.Allowed(ip) {
+			return ip
+		}
+
+		hop := net.ParseIP(chain[i])
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+func parseList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+// parseForwarded returns hosts of the "for" parameters extracted from the Forwarded header values. Elements without
+// the parameter are returned as empty strings.
+func parseForwarded(values []string) []string {
+	var hosts []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			host := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, paramValue, found := strings.Cut(pair, "=")
+				if found && strings.EqualFold(strings.TrimSpace(key), "for") {
+					host = parseForwardedNode(strings.TrimSpace(paramValue))
+				}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func parseForwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return ""
+		}
+		return node[1:end]
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// splitQuoted splits text around the separator ignoring separators enclosed in double quotes
+func splitQuoted(text string, separator byte) []string {
+	var items []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"':
+			quoted = !quoted
+		case separator:
+			if !quoted {
+				items = append(items, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(text[start:]))
+}
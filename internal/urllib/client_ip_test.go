@@ -0,0 +1,149 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package urllib
+
+import (
+	"github.com/pmateusz/glove/internal/acl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func newTrustedProxies(t *testing.T, entries ...string) acl.ACL {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		prefix, err := acl.ParsePrefix(entry)
+		require.NoError(t, err)
+		prefixes = append(prefixes, prefix)
+	}
+	return acl.NewTrie(prefixes...)
+}
+
+func newForwardedRequest(remoteAddr string, header http.Header) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header = header
+	return r
+}
+
+func TestClientIPIgnoresForwardingHeaders(t *testing.T) {
+	// GIVEN
+	r := newForwardedRequest("203.0.113.7:1234", http.Header{
+		"X-Forwarded-For": {"10.0.0.1"},
+		"X-Real-Ip":       {"10.0.0.2"},
+	})
+
+	// WHEN
+	ip := ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "203.0.113.7", ip.String())
+}
+
+func TestResolverIgnoresHeadersFromUntrustedSender(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("203.0.113.7:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "203.0.113.7", ip.String())
+}
+
+func TestResolverStopsAtFirstUntrustedHop(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{
+		"X-Forwarded-For": {"1.1.1.1, 198.51.100.1", "10.0.0.2"},
+	})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "198.51.100.1", ip.String())
+}
+
+func TestResolverReturnsLeftmostAddressOfTrustedChain(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "10.0.0.3", ip.String())
+}
+
+func TestResolverStopsAtMalformedHop(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "10.0.0.2", ip.String())
+}
+
+func TestResolverPrefersForwardedHeader(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8", "2001:db8::/32"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{
+		"Forwarded": {`for=198.51.100.1;proto=https, for="[2001:db8:cafe::17]:4711";by=10.0.0.1`,
+			`For="10.0.0.2:8080"`},
+		"X-Forwarded-For": {"203.0.113.7"},
+	})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "198.51.100.1", ip.String())
+}
+
+func TestResolverStopsAtObfuscatedForwardedNode(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1, for=_hidden"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "10.0.0.1", ip.String())
+}
+
+func TestResolverUsesRealIPFromTrustedProxy(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(newTrustedProxies(t, "10.0.0.0/8"))
+	r := newForwardedRequest("10.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Equal(t, "198.51.100.1", ip.String())
+}
+
+func TestResolverHandlesMissingRemoteAddress(t *testing.T) {
+	// GIVEN
+	resolver := NewClientIPResolver(nil)
+	r := newForwardedRequest("", http.Header{"X-Forwarded-For": {"198.51.100.1"}})
+
+	// WHEN
+	ip := resolver.ClientIP(r)
+
+	// THEN
+	assert.Nil(t, ip)
+}
@@ -6,25 +6,56 @@
 package urllib
 
 import (
+	"golang.org/x/net/http/httpguts"
 	"net"
 	"net/http"
+	"net/textproto"
 	"strings"
 )
 
-func ClientIP(r *http.Request) net.IP {
-	remoteIP := RemoteIp(r)
-	if remoteIP == nil {
-		return nil
+// hopByHopHeaders are meaningful only for a single transport-level connection and must not be forwarded by proxies,
+// see RFC 9110 7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but sent by some clients, e.g., curl
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders deletes hop-by-hop headers and headers listed in the Connection header. A protocol upgrade
+// requested in the Connection and Upgrade headers is preserved, so a websocket handshake can be forwarded. TE is
+// preserved if it announces support for trailers.
+func RemoveHopByHopHeaders(header http.Header) {
+	upgrade := ""
+	if httpguts.HeaderValuesContainsToken(header.Values("Connection"), "upgrade") {
+		upgrade = header.Get("Upgrade")
 	}
+	trailers := httpguts.HeaderValuesContainsToken(header.Values("TE"), "trailers")
 
-	for _, headerName := range []string{"X-Forwarded-For", "X-Real-IP"} {
-		ip := parseIpHeader(r.Header.Get(headerName))
-		if ip != nil {
-			return ip
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
 		}
 	}
 
-	return remoteIP
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	if upgrade != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		header.Set("TE", "trailers")
+	}
 }
 
 func RemoteIp(r *http.Request) net.IP {
@@ -34,52 +65,3 @@ func RemoteIp(r *http.Request) net.IP {
 	}
 	return net.ParseIP(ip)
 }
-
-func parseIpHeader(header string) net.IP {
-	if header == "" {
-		return nil
-	}
-
-	items := strings.Split(header, ",")
-	for i := len(items) - 1; i >= 0; i-- {
-		ipStr := strings.TrimSpace(items[i])
-		ip := net.ParseIP(ipStr)
-		if ip != nil {
-			return ip
-		}
-	}
-
-	return nil
-}
-
-func RemoveProxyHeaders(r *http.Request) {
-	r.RequestURI = "" // this must be reset when serving a request with the client
-
-	// If no Accept-Encoding header exists, Transport will add the headers it can accept
-	// and would wrap the response body with the relevant reader.
-	r.Header.Del("Accept-Encoding")
-
-	// curl can add that, see
-	// https://jdebp.eu./FGA/web-proxy-connection-header.html
-	r.Header.Del("Proxy-Connection")
-	r.Header.Del("Proxy-Authenticate")
-	r.Header.Del("Proxy-Authorization")
-
-	// Connection, Authenticate and Authorization are single hop Header:
-	// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
-	// 14.10 Connection
-	//   The Connection general-header field allows the sender to specify
-	//   options that are desired for that particular connection and MUST NOT
-	//   be communicated by proxies over further connections.
-
-	// When server reads http request it sets req.Close to true if
-	// "Connection" header contains "close".
-	// https://github.com/golang/go/blob/master/src/net/http/request.go#L1080
-	// Later, transfer.go adds "Connection: close" back when req.Close is true
-	// https://github.com/golang/go/blob/master/src/net/http/transfer.go#L275
-	// That's why tests that checks "Connection: close" removal fail
-	if r.Header.Get("Connection") == "close" {
-		r.Close = false
-	}
-	r.Header.Del("Connection")
-}
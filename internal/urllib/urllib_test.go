@@ -0,0 +1,62 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package urllib
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	// GIVEN
+	header := http.Header{
+		"Connection":          {"keep-alive, X-Connection-Option"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"Te":                  {"gzip"},
+		"Trailer":             {"X-Checksum"},
+		"X-Connection-Option": {"1"},
+		"X-End-To-End":        {"1"},
+	}
+
+	// WHEN
+	RemoveHopByHopHeaders(header)
+
+	// THEN
+	assert.Equal(t, http.Header{"X-End-To-End": {"1"}}, header)
+}
+
+func TestRemoveHopByHopHeadersPreservesUpgrade(t *testing.T) {
+	// GIVEN
+	header := http.Header{
+		"Connection":            {"keep-alive, Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+	}
+
+	// WHEN
+	RemoveHopByHopHeaders(header)
+
+	// THEN
+	assert.Equal(t, http.Header{
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+	}, header)
+}
+
+func TestRemoveHopByHopHeadersPreservesTrailersSupport(t *testing.T) {
+	// GIVEN
+	header := http.Header{"Te": {"gzip, trailers"}}
+
+	// WHEN
+	RemoveHopByHopHeaders(header)
+
+	// THEN
+	assert.Equal(t, http.Header{"Te": {"trailers"}}, header)
+}
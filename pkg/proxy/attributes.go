@@ -0,0 +1,141 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"sync"
+)
+
+// AttributeKey identifies the attribute of the type T attached to the request or to the client connection, so
+// handlers can pass values to each other without using headers. Keys are compared by identity, so each key should be
+// created once, e.g., as a package-level variable.
+type AttributeKey[T any] struct {
+	name     string
+	loggable bool
+}
+
+// NewAttributeKey returns the key of the attribute that is not logged.
+func NewAttributeKey[T any](name string) *AttributeKey[T] {
+	return &AttributeKey[T]{name: name}
+}
+
+// NewLoggableAttributeKey returns the key of the attribute that is logged under the name in the access log.
+func NewLoggableAttributeKey[T any](name string) *AttributeKey[T] {
+	return &AttributeKey[T]{name: name, loggable: true}
+}
+
+func (k *AttributeKey[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value of the attribute attached to the request or, if the request has none, to the client
+// connection.
+func (k *AttributeKey[T]) Get(c *Context) (T, bool) {
+	if value, ok := c.attributes.get(k); ok {
+		return value.(T), true
+	}
+	if value, ok := c.s.attributes.get(k); ok {
+		return value.(T), true
+	}
+
+	var zero T
+	return zero, false
+}
+
+// Set attaches the value to the request, it is discarded once the request is handled.
+func (k *AttributeKey[T]) Set(c *Context, value T) {
+	if c.attributes == nil {
+		c.attributes = &attributeStore{}
+	}
+	c.attributes.set(k, value)
+}
+
+// SetSession attaches the value to the client connection, so it is seen by handlers of the following requests sent
+// using the connection, including streams of HTTP/2 connections and requests of intercepted connections that follow
+// the CONNECT request.
+func (k *AttributeKey[T]) SetSession(c *Context, value T) {
+	if c.s.attributes == nil {
+		c.s.attributes = &attributeStore{}
+	}
+	c.s.attributes.set(k, value)
+}
+
+// Delete removes the attribute from the request and from the client connection.
+func (k *AttributeKey[T]) Delete(c *Context) {
+	c.attributes.delete(k)
+	c.s.attributes.delete(k)
+}
+
+func (k *AttributeKey[T]) attributeName() string {
+	return k.name
+}
+
+func (k *AttributeKey[T]) isLoggable() bool {
+	return k.loggable
+}
+
+type attributeKey interface {
+	attributeName() string
+	isLoggable() bool
+}
+
+// attributeStore is safe for concurrent use, because session attributes are shared by streams of HTTP/2 connections
+type attributeStore struct {
+	mu     sync.RWMutex
+	values map[attributeKey]any
+}
+
+func (s *attributeStore) get(key attributeKey) (any, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *attributeStore) set(key attributeKey, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[attributeKey]any)
+	}
+	s.values[key] = value
+}
+
+func (s *attributeStore) delete(key attributeKey) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+}
+
+// log adds loggable attributes to the event, which are skipped if they were already added by the other store
+func (s *attributeStore) log(event *zerolog.Event, logged map[attributeKey]bool) *zerolog.Event {
+	if s == nil {
+		return event
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, value := range s.values {
+		if key.isLoggable() && !logged[key] {
+			logged[key] = true
+			event = event.Interface(key.attributeName(), value)
+		}
+	}
+	return event
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type principal struct {
+	Name string `json:"name"`
+}
+
+var (
+	principalKey = NewLoggableAttributeKey[principal]("principal")
+	quotaKey     = NewAttributeKey[int]("quota")
+)
+
+func TestAttributeIsMissing(t *testing.T) {
+	c := NewTestOnlyContext(nil)
+
+	quota, ok := quotaKey.Get(c)
+
+	assert.False(t, ok)
+	assert.Zero(t, quota)
+}
+
+func TestRequestAttributeHidesSessionAttribute(t *testing.T) {
+	// GIVEN
+	c := NewTestOnlyContext(nil)
+	quotaKey.SetSession(c, 10)
+	quotaKey.Set(c, 1)
+	next := &Context{s: c.s}
+
+	// WHEN
+	requestQuota, _ := quotaKey.Get(c)
+	sessionQuota, ok := quotaKey.Get(next)
+
+	// THEN
+	assert.Equal(t, 1, requestQuota)
+	assert.True(t, ok)
+	assert.Equal(t, 10, sessionQuota)
+}
+
+func TestDeleteAttribute(t *testing.T) {
+	// GIVEN
+	c := NewTestOnlyContext(nil)
+	quotaKey.SetSession(c, 10)
+	quotaKey.Set(c, 1)
+
+	// WHEN
+	quotaKey.Delete(c)
+
+	// THEN
+	_, ok := quotaKey.Get(c)
+	assert.False(t, ok)
+}
+
+func TestLogOnlyLoggableAttributes(t *testing.T) {
+	// GIVEN
+	c := NewTestOnlyContext(nil)
+	principalKey.Set(c, principal{Name: "alice"})
+	principalKey.SetSession(c, principal{Name: "bob"})
+	quotaKey.Set(c, 1)
+	var buffer bytes.Buffer
+	logger := zerolog.New(&buffer)
+	event := logger.Info()
+
+	// WHEN
+	logged := make(map[attributeKey]bool)
+	event = c.attributes.log(event, logged)
+	c.s.attributes.log(event, logged).Msg("access")
+
+	// THEN
+	assert.Equal(t, `{"level":"info","principal":{"name":"alice"},"message":"access"}`+"\n", buffer.String())
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxBodySize    = 10 << 20
+	defaultBodyMemorySize = 1 << 20
+)
+
+// ErrBodyTooLarge is returned by RequestBody and ResponseBody of Context if the decoded body exceeds MaxBodySize of the
+// rule.
+var ErrBodyTooLarge = errors.New("proxy: body too large")
+
+// BufferedBody is the decoded body of the request or the response read by the handler. The body is kept in memory up
+// to BodyMemorySize of the rule, the rest is written to a temporary file, which is removed once the request is handled.
+// The body is compressed again using the content encoding of the message before it is sent.
+type BufferedBody struct {
+	encoding    string
+	memoryLimit int64
+	content     *spillBuffer
+}
+
+// Encoding returns the content encoding of the message, the body returned by Bytes and Reader is already decoded.
+func (b *BufferedBody) Encoding() string {
+	return b.encoding
+}
+
+// Len returns the size of the decoded body.
+func (b *BufferedBody) Len() int64 {
+	return b.content.size
+}
+
+// Reader returns a new reader of the decoded body.
+func (b *BufferedBody) Reader() io.Reader {
+	return b.content.Reader()
+}
+
+// Bytes returns the decoded body, which is read from the temporary file if it doesn't fit in memory.
+func (b *BufferedBody) Bytes() ([]byte, error) {
+	if b.content.file == nil {
+		return b.content.memory.Bytes(), nil
+	}
+	return io.ReadAll(b.content.Reader())
+}
+
+// Replace sets the decoded body sent instead of the original body, the Content-Length header is updated once the body
+// is encoded.
+func (b *BufferedBody) Replace(data []byte) error {
+	content := &spillBuffer{memoryLimit: b.memoryLimit}
+	if _, err := content.Write(data); err != nil {
+		_ = content.Close()
+		return err
+	}
+
+	_ = b.content.Close()
+	b.content = content
+	return nil
+}
+
+// Close removes the temporary file of the body.
+func (b *BufferedBody) Close() error {
+	return b.content.Close()
+}
+
+// encode returns the body compressed using the content encoding of the message and its size. Closing the reader
+// removes the temporary file of the compressed body.
+func (b *BufferedBody) encode() (io.ReadCloser, int64, error) {
+	if isIdentityEncoding(b.encoding) {
+		return io.NopCloser(b.content.Reader()), b.content.size, nil
+	}
+
+	encoded := &spillBuffer{memoryLimit: b.memoryLimit}
+	encoder, err := newBodyEncoder(encoded, b.encoding)
+	if err == nil {
+		_, err = io.Copy(encoder, b.content.Reader())
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		_ = encoded.Close()
+		return nil, 0, err
+	}
+	return &spillReader{Reader: encoded.Reader(), buffer: encoded}, encoded.size, nil
+}
+
+// readBody decodes the body according to the content encoding. At most maxSize+1 bytes are read, so the temporary file
+// doesn't grow beyond the limit.
+func readBody(body io.Reader, encoding string, memoryLimit, maxSize int64) (*BufferedBody, error) {
+	decoder, err := newBodyDecoder(body, encoding)
+	if errors.Is(err, io.EOF) {
+		// the compressed body is empty, e.g., the response to the HEAD request
+		decoder, err = http.NoBody, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = decoder.Close() }()
+
+	content := &spillBuffer{memoryLimit: memoryLimit}
+	if _, err = io.Copy(content, io.LimitReader(decoder, maxSize+1)); err != nil {
+		_ = content.Close()
+		return nil, err
+	}
+	if content.size > maxSize {
+		_ = content.Close()
+		return nil, fmt.Errorf("%w: the limit is %d bytes", ErrBodyTooLarge, maxSize)
+	}
+	return &BufferedBody{encoding: encoding, memoryLimit: memoryLimit, content: content}, nil
+}
+
+// setBody replaces the body of the message with the buffered body, the length is also set in headers, so it is seen
+// by hooks
+func setBody(b *BufferedBody, header http.Header, body *io.ReadCloser, contentLength *int64, transferEncoding *[]string) error {
+	encoded, size, err := b.encode()
+	if err != nil {
+		return err
+	}
+
+	*body, *contentLength, *transferEncoding = encoded, size, nil
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Del("Transfer-Encoding")
+	return nil
+}
+
+// hasResponseBody reports whether the response may have a body, so its length is sent
+func hasResponseBody(r *http.Request, resp *http.Response) bool {
+	if r != nil && r.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified
+}
+
+func isIdentityEncoding(encoding string) bool {
+	return encoding == "" || strings.EqualFold(encoding, "identity")
+}
+
+func newBodyDecoder(body io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported content encoding %q", encoding)
+	}
+}
+
+func newBodyEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported content encoding %q", encoding)
+	}
+}
+
+// bufferedBodyReader reads the current content of the buffered body, so handlers see the body set by Replace
+type bufferedBodyReader struct {
+	body    *BufferedBody
+	content *spillBuffer
+	reader  io.Reader
+}
+
+func newBufferedBodyReader(body *BufferedBody) io.ReadCloser {
+	return &bufferedBodyReader{body: body}
+}
+
+func (r *bufferedBodyReader) Read(p []byte) (int, error) {
+	if r.content != r.body.content {
+		r.content, r.reader = r.body.content, r.body.content.Reader()
+	}
+	return r.reader.Read(p)
+}
+
+func (r *bufferedBodyReader) Close() error {
+	return nil
+}
+
+// spillBuffer keeps the first memoryLimit bytes in memory and moves the content to a temporary file once it grows
+// beyond the limit
+type spillBuffer struct {
+	memoryLimit int64
+	memory      bytes.Buffer
+	file        *os.File
+	size        int64
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.memoryLimit {
+		file, err := os.CreateTemp("", "glove-body-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err = file.Write(s.memory.Bytes()); err != nil {
+			return 0, err
+		}
+		s.memory = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.memory.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *spillBuffer) Reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.memory.Bytes())
+}
+
+func (s *spillBuffer) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	file := s.file
+	s.file = nil
+	closeErr := file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// spillReader removes the temporary file of the buffer once the body is closed
+type spillReader struct {
+	io.Reader
+	buffer *spillBuffer
+}
+
+func (r *spillReader) Close() error {
+	return r.buffer.Close()
+}
+
+// errorBody fails reads of the body that could not be buffered, so the message isn't sent with a truncated body
+type errorBody struct {
+	err error
+}
+
+func (b errorBody) Read([]byte) (int, error) {
+	return 0, b.err
+}
+
+func (b errorBody) Close() error {
+	return nil
+}
+
+// readBody buffers the body using limits of the rule
+func (s *session) readBody(body io.Reader, header http.Header) (*BufferedBody, error) {
+	if body == nil {
+		body = http.NoBody
+	}
+
+	maxSize, memoryLimit := s.rule.MaxBodySize, s.rule.BodyMemorySize
+	if maxSize <= 0 {
+		maxSize = defaultMaxBodySize
+	}
+	if memoryLimit <= 0 {
+		memoryLimit = defaultBodyMemorySize
+	}
+	return readBody(body, header.Get("Content-Encoding"), memoryLimit, maxSize)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func encodeTestBody(t *testing.T, encoding, data string) io.Reader {
+	if encoding == "" {
+		return strings.NewReader(data)
+	}
+
+	var buffer bytes.Buffer
+	encoder, err := newBodyEncoder(&buffer, encoding)
+	require.NoError(t, err)
+	_, err = encoder.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, encoder.Close())
+	return &buffer
+}
+
+func TestReadBodyDecodesContentEncoding(t *testing.T) {
+	for _, encoding := range []string{"", "gzip", "deflate", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			// GIVEN
+			body := encodeTestBody(t, encoding, "hello world")
+
+			// WHEN
+			buffered, err := readBody(body, encoding, 1024, 1024)
+
+			// THEN
+			require.NoError(t, err)
+			data, _ := buffered.Bytes()
+			assert.Equal(t, "hello world", string(data))
+			assert.Equal(t, int64(11), buffered.Len())
+			assert.Equal(t, encoding, buffered.Encoding())
+		})
+	}
+}
+
+func TestReadBodyFailsIfBodyIsTooLarge(t *testing.T) {
+	body := encodeTestBody(t, "gzip", strings.Repeat("a", 101))
+
+	_, err := readBody(body, "gzip", 10, 100)
+
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.EqualError(t, err, "proxy: body too large: the limit is 100 bytes")
+}
+
+func TestReadBodyFailsIfEncodingIsUnsupported(t *testing.T) {
+	_, err := readBody(strings.NewReader("hello"), "zstd", 10, 100)
+
+	assert.EqualError(t, err, `proxy: unsupported content encoding "zstd"`)
+}
+
+func TestBufferedBodySpillsToTemporaryFile(t *testing.T) {
+	// GIVEN
+	data := strings.Repeat("0123456789", 10)
+	buffered, err := readBody(strings.NewReader(data), "", 16, 1024)
+	require.NoError(t, err)
+	fileName := buffered.content.file.Name()
+
+	// WHEN
+	readData, readErr := buffered.Bytes()
+	closeErr := buffered.Close()
+
+	// THEN
+	assert.NoError(t, readErr)
+	assert.Equal(t, data, string(readData))
+	assert.NoError(t, closeErr)
+	_, statErr := os.Stat(fileName)
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestEncodeReplacedBody(t *testing.T) {
+	// GIVEN
+	buffered, err := readBody(encodeTestBody(t, "br", "hello"), "br", 1024, 1024)
+	require.NoError(t, err)
+	require.NoError(t, buffered.Replace([]byte("hello world")))
+
+	// WHEN
+	encoded, size, encodeErr := buffered.encode()
+
+	// THEN
+	require.NoError(t, encodeErr)
+	data, _ := io.ReadAll(encoded)
+	assert.Equal(t, int64(len(data)), size)
+	decoded, decodeErr := readBody(bytes.NewReader(data), "br", 1024, 1024)
+	require.NoError(t, decodeErr)
+	decodedData, _ := decoded.Bytes()
+	assert.Equal(t, "hello world", string(decodedData))
+}
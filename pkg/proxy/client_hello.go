@@ -0,0 +1,218 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	tlsRecordHeaderLength   = 5
+	tlsMaxRecordLength      = 1 << 14
+	tlsHandshakeRecordType  = 0x16
+	tlsClientHelloType      = 0x01
+	tlsServerNameExtension  = 0x0000
+	tlsALPNExtension        = 0x0010
+	tlsServerNameHostType   = 0x00
+	clientHelloPeekCapacity = tlsRecordHeaderLength + tlsMaxRecordLength
+)
+
+var errInvalidClientHello = errors.New("tls: invalid client hello")
+
+type clientHello struct {
+	serverName    string
+	alpnProtocols []string
+}
+
+// isTLSHandshake reports whether the client started the connection with a TLS handshake record
+func isTLSHandshake(r *bufio.Reader) bool {
+	header, err := r.Peek(1)
+	return err == nil && header[0] == tlsHandshakeRecordType
+}
+
+// peekClientHello parses the ClientHello message without consuming it from the reader. The message may be split
+// across multiple records as long as they fit into the buffer of the reader.
+func peekClientHello(r *bufio.Reader) (*clientHello, error) {
+	var message []byte
+	offset := 0
+	for {
+		header, peekErr := r.Peek(offset + tlsRecordHeaderLength)
+		if peekErr != nil {
+			return nil, peekErr
+		}
+
+		header = header[offset:]
+		if header[0] != tlsHandshakeRecordType {
+			return nil, errInvalidClientHello
+		}
+
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length == 0 || length > tlsMaxRecordLength {
+			return nil, errInvalidClientHello
+		}
+
+		record, peekRecordErr := r.Peek(offset + tlsRecordHeaderLength + length)
+		if peekRecordErr != nil {
+			return nil, peekRecordErr
+		}
+		message = append(message, record[offset+tlsRecordHeaderLength:]...)
+		offset += tlsRecordHeaderLength + length
+
+		if len(message) >= 4 {
+			messageLength := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+messageLength {
+				return parseClientHello(message[:4+messageLength])
+			}
+		}
+	}
+}
+
+func parseClientHello(message []byte) (*clientHello, error) {
+	m := helloReader(message)
+	if handshakeType, ok := m.uint8(); !ok || handshakeType != tlsClientHelloType {
+		return nil, errInvalidClientHello
+	}
+
+	// skip handshake length, client version and random
+	if !m.skip(3 + 2 + 32) {
+		return nil, errInvalidClientHello
+	}
+
+	// skip session id, cipher suites and compression methods
+	if _, ok := m.vector8(); !ok {
+		return nil, errInvalidClientHello
+	}
+	if _, ok := m.vector16(); !ok {
+		return nil, errInvalidClientHello
+	}
+	if _, ok := m.vector8(); !ok {
+		return nil, errInvalidClientHello
+	}
+
+	hello := &clientHello{}
+	if len(m) == 0 {
+		// extensions are optional
+		return hello, nil
+	}
+
+	extensions, ok := m.vector16()
+	if !ok {
+		return nil, errInvalidClientHello
+	}
+
+	for len(extensions) > 0 {
+		extensionType, typeOk := extensions.uint16()
+		data, dataOk := extensions.vector16()
+		if !typeOk || !dataOk {
+			return nil, errInvalidClientHello
+		}
+
+		if extensionType == tlsServerNameExtension {
+			serverName, parseOk := parseServerName(data)
+			if !parseOk {
+				return nil, errInvalidClientHello
+			}
+			hello.serverName = serverName
+		} else if extensionType == tlsALPNExtension {
+			protocols, parseOk := parseALPNProtocols(data)
+			if !parseOk {
+				return nil, errInvalidClientHello
+			}
+			hello.alpnProtocols = protocols
+		}
+	}
+
+	return hello, nil
+}
+
+func parseServerName(data helloReader) (string, bool) {
+	names, ok := data.vector16()
+	if !ok {
+		return "", false
+	}
+
+	for len(names) > 0 {
+		nameType, typeOk := names.uint8()
+		name, nameOk := names.vector16()
+		if !typeOk || !nameOk {
+			return "", false
+		}
+
+		if nameType == tlsServerNameHostType {
+			return string(name), true
+		}
+	}
+
+	return "", true
+}
+
+func parseALPNProtocols(data helloReader) ([]string, bool) {
+	names, ok := data.vector16()
+	if !ok {
+		return nil, false
+	}
+
+	var protocols []string
+	for len(names) > 0 {
+		name, nameOk := names.vector8()
+		if !nameOk || len(name) == 0 {
+			return nil, false
+		}
+		protocols = append(protocols, string(name))
+	}
+	return protocols, true
+}
+
+// helloReader consumes fields of a TLS handshake message
+type helloReader []byte
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) vector8() (helloReader, bool) {
+	length, ok := r.uint8()
+	if !ok || len(*r) < int(length) {
+		return nil, false
+	}
+	v := (*r)[:length]
+	*r = (*r)[length:]
+	return v, true
+}
+
+func (r *helloReader) vector16() (helloReader, bool) {
+	length, ok := r.uint16()
+	if !ok || len(*r) < int(length) {
+		return nil, false
+	}
+	v := (*r)[:length]
+	*r = (*r)[length:]
+	return v, true
+}
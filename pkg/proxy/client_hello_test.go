@@ -0,0 +1,125 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recordClientHello returns the bytes sent by the TLS client before it waits for the ServerHello
+func recordClientHello(t *testing.T, config *tls.Config) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer func() { _ = serverConn.Close() }()
+
+	go func() {
+		_ = tls.Client(clientConn, config).Handshake()
+	}()
+
+	reader := bufio.NewReader(serverConn)
+	header := make([]byte, tlsRecordHeaderLength)
+	_, headerErr := io.ReadFull(reader, header)
+	require.NoError(t, headerErr)
+
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	_, recordErr := io.ReadFull(reader, record)
+	require.NoError(t, recordErr)
+	_ = clientConn.Close()
+
+	return append(header, record...)
+}
+
+func TestPeekClientHelloWithServerName(t *testing.T) {
+	// GIVEN
+	message := recordClientHello(t, &tls.Config{ServerName: "example.com"})
+	reader := bufio.NewReaderSize(bytes.NewReader(message), clientHelloPeekCapacity)
+
+	// WHEN
+	hello, err := peekClientHello(reader)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", hello.serverName)
+	assert.Empty(t, hello.alpnProtocols)
+	assert.Equal(t, len(message), reader.Buffered(), "client hello must not be consumed")
+}
+
+func TestPeekClientHelloWithALPN(t *testing.T) {
+	// GIVEN
+	message := recordClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	reader := bufio.NewReaderSize(bytes.NewReader(message), clientHelloPeekCapacity)
+
+	// WHEN
+	hello, err := peekClientHello(reader)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.alpnProtocols)
+}
+
+func TestPeekClientHelloWithoutServerName(t *testing.T) {
+	// GIVEN
+	message := recordClientHello(t, &tls.Config{InsecureSkipVerify: true})
+	reader := bufio.NewReaderSize(bytes.NewReader(message), clientHelloPeekCapacity)
+
+	// WHEN
+	hello, err := peekClientHello(reader)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Empty(t, hello.serverName)
+}
+
+func TestPeekClientHelloSplitAcrossRecords(t *testing.T) {
+	// GIVEN
+	message := recordClientHello(t, &tls.Config{ServerName: "example.com"})
+	payload := message[tlsRecordHeaderLength:]
+	split := []byte{tlsHandshakeRecordType, message[1], message[2], 0x00, 0x10}
+	split = append(split, payload[:16]...)
+	rest := len(payload) - 16
+	split = append(split, tlsHandshakeRecordType, message[1], message[2], byte(rest>>8), byte(rest))
+	split = append(split, payload[16:]...)
+	reader := bufio.NewReaderSize(bytes.NewReader(split), clientHelloPeekCapacity)
+
+	// WHEN
+	hello, err := peekClientHello(reader)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", hello.serverName)
+}
+
+func TestPeekClientHelloRejectsPlainHTTP(t *testing.T) {
+	// GIVEN
+	reader := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	// WHEN
+	isTLS := isTLSHandshake(reader)
+	_, err := peekClientHello(reader)
+
+	// THEN
+	assert.False(t, isTLS)
+	assert.ErrorIs(t, err, errInvalidClientHello)
+}
+
+func TestPeekClientHelloRejectsTruncatedMessage(t *testing.T) {
+	// GIVEN
+	message := recordClientHello(t, &tls.Config{ServerName: "example.com"})
+	reader := bufio.NewReader(bytes.NewReader(message[:len(message)-16]))
+
+	// WHEN
+	_, err := peekClientHello(reader)
+
+	// THEN
+	assert.ErrorIs(t, err, io.EOF)
+}
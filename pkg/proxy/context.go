@@ -6,8 +6,13 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/pmateusz/glove/internal/urllib"
 	"github.com/rs/zerolog"
+	"net"
 	"net/http"
 )
 
@@ -15,7 +20,14 @@ type Context struct {
 	Request  *http.Request
 	Response *http.Response
 
-	s *session
+	ctx        context.Context
+	attributes *attributeStore
+	s          *session
+
+	requestBody  *BufferedBody
+	responseBody *BufferedBody
+	// bufferedResponse is the response whose body was buffered, the body is not applied to responses set later
+	bufferedResponse *http.Response
 }
 
 func NewTestOnlyContext(handler Handler) *Context {
@@ -28,6 +40,155 @@ func NewTestOnlyContext(handler Handler) *Context {
 	return &Context{s: s}
 }
 
+// Ctx returns the context of the request, which is cancelled once the request is handled, including the tunnel opened
+// by the CONNECT request, or once the client disconnects, the session is closed or the engine is closed. The client
+// disconnect is detected only while the connection isn't read, i.e., it is detected for requests without a body and
+// once the body was sent to the origin server. The context is used to dial the origin server and to read the response,
+// so handlers can set a deadline or attach values passed to the dialer using SetCtx.
+func (c *Context) Ctx() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// SetCtx replaces the context of the request, which should be derived from Ctx, so it is still cancelled when the
+// client disconnects.
+func (c *Context) SetCtx(ctx context.Context) {
+	c.ctx = ctx
+	c.s.requestCtx = ctx
+}
+
+// ClientIP returns the address of the client that sent the request. Forwarding headers are considered only if the
+// request was received from a proxy trusted by the engine.
+func (c *Context) ClientIP() net.IP {
+	if c.s.engine == nil {
+		return urllib.ClientIP(c.Request)
+	}
+	return c.s.engine.clientIPResolver.ClientIP(c.Request)
+}
+
+// Action returns the action applied to the connection, which is the action of the rule unless it was set by SetAction.
+func (c *Context) Action() Action {
+	return c.s.action()
+}
+
+// SetAction applies the action to the connection instead of the action of the rule. Called for the CONNECT request
+// before Next, it decides whether the connection is tunneled, intercepted or blocked. BlockAction also blocks other
+// requests.
+func (c *Context) SetAction(action Action) {
+	c.s.overrideAction = &action
+}
+
+// SetUpstreamAddr directs the connection to the host and port instead of the host of the request. The address is used
+// once the connection to the origin server is opened, so it should be set for the CONNECT request or the first request
+// of the client connection. The TLS server name is still the host of the request.
+func (c *Context) SetUpstreamAddr(addr string) {
+	c.s.upstreamAddr = addr
+}
+
+// SetClientTLSConfig sets the TLS configuration presented to the client of the intercepted connection instead of the
+// configuration of the rule. It must be set for the CONNECT request.
+func (c *Context) SetClientTLSConfig(config *tls.Config) {
+	c.s.overrideClientConfig = config
+}
+
+// SetServerTLSConfig sets the TLS configuration used to connect to the origin server of the intercepted connection
+// instead of the configuration of the rule. HTTP/2 connections opened using the configuration are shared only with
+// sessions using the same configuration.
+func (c *Context) SetServerTLSConfig(config *tls.Config) {
+	c.s.overrideServerConfig = config
+}
+
+// RequestBody reads and decodes the body of the request, so handlers can inspect or replace it before Next. The body
+// is sent to the origin server compressed again using the original content encoding with the updated Content-Length.
+// ErrBodyTooLarge is returned if the decoded body exceeds MaxBodySize of the rule. The request can't be sent if reading
+// the body fails, so the handler should answer it instead.
+func (c *Context) RequestBody() (*BufferedBody, error) {
+	if c.requestBody != nil {
+		return c.requestBody, nil
+	}
+
+	body, err := c.s.readBody(c.Request.Body, c.Request.Header)
+	if c.Request.Body != nil {
+		_ = c.Request.Body.Close()
+	}
+	if err != nil {
+		// the rest of the body is not read, so the client connection can't be reused
+		c.s.close = true
+		c.Request.Body = errorBody{err: err}
+		return nil, err
+	}
+	c.requestBody, c.Request.Body = body, newBufferedBodyReader(body)
+	return body, nil
+}
+
+// ResponseBody reads and decodes the body of the response, so handlers can inspect or replace it after Next. The body
+// is sent to the client compressed again using the original content encoding with the updated Content-Length.
+// ErrBodyTooLarge is returned if the decoded body exceeds MaxBodySize of the rule.
+func (c *Context) ResponseBody() (*BufferedBody, error) {
+	if c.Response == nil {
+		return nil, errors.New("proxy: no response")
+	}
+	if c.responseBody != nil && c.bufferedResponse == c.Response {
+		return c.responseBody, nil
+	}
+
+	body, err := c.s.readBody(c.Response.Body, c.Response.Header)
+	if c.Response.Body != nil {
+		_ = c.Response.Body.Close()
+	}
+	if err != nil {
+		c.Response.Body = errorBody{err: err}
+		return nil, err
+	}
+	if c.responseBody != nil {
+		_ = c.responseBody.Close()
+	}
+	c.responseBody, c.bufferedResponse, c.Response.Body = body, c.Response, newBufferedBodyReader(body)
+	return body, nil
+}
+
+// closeBodies removes temporary files of buffered bodies
+func (c *Context) closeBodies() {
+	if c.requestBody != nil {
+		_ = c.requestBody.Close()
+	}
+	if c.responseBody != nil {
+		_ = c.responseBody.Close()
+	}
+}
+
+// IsGRPC reports whether the request is a gRPC call.
+func (c *Context) IsGRPC() bool {
+	return isGRPC(c.Request)
+}
+
+// GRPCMethod returns the full method name of the gRPC call, e.g., /pkg.Service/Method, or an empty string if the
+// request is not a gRPC call.
+func (c *Context) GRPCMethod() string {
+	if !c.IsGRPC() {
+		return ""
+	}
+	return c.Request.URL.Path
+}
+
+// GRPCStatus returns the status code and message of the gRPC call. The status is sent in trailers, which are known
+// once the response body is read, so before the response is sent to the client the status is available only for
+// trailers-only responses, e.g., calls rejected by handlers or failed by the origin server.
+func (c *Context) GRPCStatus() (GRPCCode, string, bool) {
+	if c.Response == nil {
+		return 0, "", false
+	}
+	return grpcStatus(c.Response)
+}
+
+// RejectGRPC ends the gRPC call with the status code and message instead of sending it to the origin server. Unlike
+// HTTP status codes, the gRPC status is understood by gRPC clients.
+func (c *Context) RejectGRPC(code GRPCCode, message string) {
+	c.Response = newGRPCResponse(code, message, c.Request)
+}
+
 func (c *Context) Next() {
 	defer func() {
 		if r := recover(); r != nil {
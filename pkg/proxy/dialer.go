@@ -0,0 +1,60 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultDialTimeout limits the time to connect to the origin server, including the TLS handshake and the CONNECT
+// request sent to the upstream proxy
+const defaultDialTimeout = 30 * time.Second
+
+// aLongTimeAgo is a deadline in the past used to interrupt blocked reads
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Dialer opens connections to origin servers and upstream proxies. The context is cancelled if the client
+// disconnects or the dial timeout elapses. *net.Dialer implements the interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// forwardDialer adapts the Dialer to the interface used by golang.org/x/net/proxy
+type forwardDialer struct {
+	Dialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// withConnContext interrupts the blocking operations on the connection when the context is done. The returned
+// function must be called once the operations complete.
+func withConnContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(aLongTimeAgo)
+	})
+
+	return func() {
+		stop()
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// contextErr returns the error of the context that interrupted an operation, so it can be told apart from errors
+// of the network
+func contextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return errors.Join(ctxErr, err)
+	}
+	return err
+}
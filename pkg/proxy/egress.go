@@ -0,0 +1,412 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEgressCooldown = time.Minute
+
+var errEgressExhausted = errors.New("proxy: all egress addresses are excluded")
+
+// EgressStrategy selects the local address of connections opened by the egress pool.
+type EgressStrategy int32
+
+const (
+	// RoundRobinEgress uses the addresses in turns.
+	RoundRobinEgress EgressStrategy = iota
+	// LeastUsedEgress uses the address with the fewest open connections.
+	LeastUsedEgress
+	// StickyClientEgress uses the same address for connections of the same client IP address.
+	StickyClientEgress
+	// StickyKeyEgress uses the same address for requests with the same API key, or the same client IP address if
+	// the request has no key.
+	StickyKeyEgress
+)
+
+func ParseEgressStrategy(strategyName string) (EgressStrategy, error) {
+	if strategyName == "" {
+		return RoundRobinEgress, nil
+	}
+
+	switch strings.ToUpper(strings.ReplaceAll(strategyName, "-", "")) {
+	case "ROUNDROBIN":
+		return RoundRobinEgress, nil
+	case "LEASTUSED":
+		return LeastUsedEgress, nil
+	case "STICKYCLIENT":
+		return StickyClientEgress, nil
+	case "STICKYKEY":
+		return StickyKeyEgress, nil
+	default:
+		return 0, fmt.Errorf("failed to parse egress strategy %q, supported strategies are: round-robin, least-used, sticky-client or sticky-key", strategyName)
+	}
+}
+
+type EgressStats struct {
+	Addr          netip.Addr
+	Active        int
+	Total         uint64
+	Failed        uint64
+	Rejected      uint64
+	ExcludedUntil time.Time
+}
+
+type EgressOptions struct {
+	strategy EgressStrategy
+	cooldown time.Duration
+	key      func(r *http.Request) string
+	dialer   *net.Dialer
+}
+
+type EgressOption func(opts *EgressOptions)
+
+// WithEgressStrategy sets the strategy used to select the local address. Round-robin is used by default.
+func WithEgressStrategy(strategy EgressStrategy) EgressOption {
+	return func(opts *EgressOptions) {
+		opts.strategy = strategy
+	}
+}
+
+// WithEgressCooldown sets the time an address is excluded from the pool after the origin server responded with
+// 418 I'm a teapot or 429 Too Many Requests. A longer Retry-After header sent in the response takes precedence.
+func WithEgressCooldown(cooldown time.Duration) EgressOption {
+	return func(opts *EgressOptions) {
+		opts.cooldown = cooldown
+	}
+}
+
+// WithEgressKey sets the function returning the API key of the request, which is used by the sticky-key strategy. The
+// connection to the origin server is opened again if a request has another key than the request that opened it. The
+// key of tunneled connections is read from the CONNECT request, because other requests are not seen by the proxy.
+func WithEgressKey(key func(r *http.Request) string) EgressOption {
+	return func(opts *EgressOptions) {
+		opts.key = key
+	}
+}
+
+// WithEgressKeyHeader reads the API key used by the sticky-key strategy from the request header.
+func WithEgressKeyHeader(name string) EgressOption {
+	return WithEgressKey(func(r *http.Request) string {
+		return r.Header.Get(name)
+	})
+}
+
+// WithEgressDialer sets the dialer copied to open connections from each address of the pool. The dialer is used only if
+// the pool dials connections itself, the engine passes its own dialer to the pool.
+func WithEgressDialer(dialer *net.Dialer) EgressOption {
+	return func(opts *EgressOptions) {
+		opts.dialer = dialer
+	}
+}
+
+type egressAddr struct {
+	addr netip.Addr
+
+	active        int
+	total         uint64
+	failed        uint64
+	rejected      uint64
+	excludedUntil time.Time
+}
+
+// EgressPool is a Dialer that binds outgoing connections to one of the local addresses, so origin servers applying
+// rate limits per source IP address see the traffic spread across the addresses.
+type EgressPool struct {
+	options EgressOptions
+
+	mu    sync.Mutex
+	addrs []*egressAddr
+	next  int
+	now   func() time.Time
+}
+
+func NewEgressPool(addrs []netip.Addr, opts ...EgressOption) (*EgressPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("egress pool requires at least one address")
+	}
+
+	options := EgressOptions{
+		cooldown: defaultEgressCooldown,
+		dialer: &net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	pool := &EgressPool{
+		options: options,
+		now:     time.Now,
+	}
+	for _, addr := range addrs {
+		pool.addrs = append(pool.addrs, &egressAddr{addr: addr.Unmap()})
+	}
+	return pool, nil
+}
+
+// EgressAddrFromContext returns the local address selected by the egress pool for the connection. Dialers other than
+// *net.Dialer passed to the engine along with the pool bind the connection to the address themselves.
+func EgressAddrFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(egressAddrKey{}).(netip.Addr)
+	return addr, ok
+}
+
+func (p *EgressPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.dial(ctx, p.options.dialer, network, addr)
+}
+
+// wrap returns the dialer that opens connections from addresses of the pool using the dialer, the pool dials
+// connections itself if the dialer is not set
+func (p *EgressPool) wrap(dialer Dialer) Dialer {
+	if dialer == nil {
+		return p
+	}
+	return &egressDialer{pool: p, dialer: dialer}
+}
+
+func (p *EgressPool) dial(ctx context.Context, dialer Dialer, network, addr string) (net.Conn, error) {
+	egress, selectErr := p.acquire(p.stickyKey(ctx))
+	if selectErr != nil {
+		return nil, selectErr
+	}
+
+	if netDialer, ok := dialer.(*net.Dialer); ok {
+		localDialer := *netDialer
+		localDialer.LocalAddr = &net.TCPAddr{IP: egress.addr.AsSlice()}
+		dialer = &localDialer
+	} else {
+		ctx = context.WithValue(ctx, egressAddrKey{}, egress.addr)
+	}
+
+	conn, dialErr := dialer.DialContext(ctx, network, addr)
+	if dialErr != nil {
+		p.mu.Lock()
+		egress.active -= 1
+		egress.failed += 1
+		p.mu.Unlock()
+		return nil, dialErr
+	}
+
+	return &egressConn{Conn: conn, release: func() {
+		p.mu.Lock()
+		egress.active -= 1
+		p.mu.Unlock()
+	}}, nil
+}
+
+// Stats returns metrics of each address in the pool.
+func (p *EgressPool) Stats() []EgressStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]EgressStats, 0, len(p.addrs))
+	for _, egress := range p.addrs {
+		stats = append(stats, egress.stats())
+	}
+	return stats
+}
+
+// excluded reports whether the local address of the connection is excluded from the pool
+func (p *EgressPool) excluded(localAddr net.Addr) bool {
+	addr, ok := egressAddrOf(localAddr)
+	if !ok {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, egress := range p.addrs {
+		if egress.addr == addr {
+			return p.now().Before(egress.excludedUntil)
+		}
+	}
+	return false
+}
+
+// observe excludes the local address of the connection from the pool if the response signals the address is rate
+// limited or banned. Metrics of the excluded address are returned.
+func (p *EgressPool) observe(localAddr net.Addr, resp *http.Response) (EgressStats, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusTeapot {
+		return EgressStats{}, false
+	}
+
+	addr, ok := egressAddrOf(localAddr)
+	if !ok {
+		return EgressStats{}, false
+	}
+
+	cooldown := p.options.cooldown
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > cooldown {
+		cooldown = time.Duration(seconds) * time.Second
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, egress := range p.addrs {
+		if egress.addr == addr {
+			egress.rejected += 1
+			egress.excludedUntil = p.now().Add(cooldown)
+			return egress.stats(), true
+		}
+	}
+	return EgressStats{}, false
+}
+
+func (p *EgressPool) stickyKey(ctx context.Context) string {
+	info, ok := ctx.Value(dialInfoKey{}).(*dialInfo)
+	if !ok {
+		return ""
+	}
+	return p.requestKey(info.clientIP, info.request)
+}
+
+// requestKey returns the key the sticky strategies select the address by for the request sent by the client
+func (p *EgressPool) requestKey(clientIP net.IP, r *http.Request) string {
+	switch p.options.strategy {
+	case StickyKeyEgress:
+		if p.options.key != nil && r != nil {
+			if key := p.options.key(r); key != "" {
+				return "key:" + key
+			}
+		}
+		fallthrough
+	case StickyClientEgress:
+		if clientIP != nil {
+			return "ip:" + clientIP.String()
+		}
+	}
+	return ""
+}
+
+func (p *EgressPool) acquire(stickyKey string) (*egressAddr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var selected *egressAddr
+	switch {
+	case stickyKey != "":
+		// rendezvous hashing keeps the assignment of other keys when an address is excluded
+		var maxWeight uint64
+		for _, egress := range p.addrs {
+			if now.Before(egress.excludedUntil) {
+				continue
+			}
+
+			hash := fnv.New64a()
+			_, _ = hash.Write([]byte(stickyKey))
+			_, _ = hash.Write(egress.addr.AsSlice())
+			if weight := hash.Sum64(); selected == nil || weight > maxWeight {
+				selected, maxWeight = egress, weight
+			}
+		}
+	case p.options.strategy == LeastUsedEgress:
+		for i := range p.addrs {
+			egress := p.addrs[(p.next+i)%len(p.addrs)]
+			if now.Before(egress.excludedUntil) {
+				continue
+			}
+			if selected == nil || egress.active < selected.active {
+				selected = egress
+			}
+		}
+		p.next = (p.next + 1) % len(p.addrs)
+	default:
+		for i := range p.addrs {
+			egress := p.addrs[(p.next+i)%len(p.addrs)]
+			if now.Before(egress.excludedUntil) {
+				continue
+			}
+			selected = egress
+			p.next = (p.next + i + 1) % len(p.addrs)
+			break
+		}
+	}
+
+	if selected == nil {
+		return nil, errEgressExhausted
+	}
+	selected.active += 1
+	selected.total += 1
+	return selected, nil
+}
+
+// egressAddrOf returns the IP address of the local address of the connection
+func egressAddrOf(localAddr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := localAddr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return addr.Unmap(), ok
+}
+
+func (e *egressAddr) stats() EgressStats {
+	return EgressStats{
+		Addr:          e.addr,
+		Active:        e.active,
+		Total:         e.total,
+		Failed:        e.failed,
+		Rejected:      e.rejected,
+		ExcludedUntil: e.excludedUntil,
+	}
+}
+
+// egressDialer opens connections from addresses of the pool using the dialer of the engine
+type egressDialer struct {
+	pool   *EgressPool
+	dialer Dialer
+}
+
+func (d *egressDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.pool.dial(ctx, d.dialer, network, addr)
+}
+
+// egressConn releases the slot of the address in the pool once on Close
+type egressConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *egressConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (c *egressConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type egressAddrKey struct{}
+
+type dialInfoKey struct{}
+
+// dialInfo describes the request that opens the connection to the origin server
+type dialInfo struct {
+	clientIP net.IP
+	request  *http.Request
+	hosts    map[string][]netip.Addr
+	logger   *zerolog.Logger
+}
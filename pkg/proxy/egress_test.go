@@ -0,0 +1,193 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var egressAddrs = []netip.Addr{
+	netip.MustParseAddr("192.0.2.1"),
+	netip.MustParseAddr("192.0.2.2"),
+	netip.MustParseAddr("192.0.2.3"),
+}
+
+func newTestEgressPool(t *testing.T, opts ...EgressOption) (*EgressPool, *time.Time) {
+	pool, err := NewEgressPool(egressAddrs, opts...)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	pool.now = func() time.Time { return now }
+	return pool, &now
+}
+
+func acquireAddr(t *testing.T, pool *EgressPool, stickyKey string) netip.Addr {
+	egress, err := pool.acquire(stickyKey)
+	require.NoError(t, err)
+	return egress.addr
+}
+
+func tooManyRequests(retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: make(http.Header)}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestEgressPoolRoundRobin(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t)
+
+	// WHEN-THEN
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, egressAddrs[i%3], acquireAddr(t, pool, ""))
+	}
+}
+
+func TestEgressPoolLeastUsed(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t, WithEgressStrategy(LeastUsedEgress))
+	pool.addrs[0].active = 2
+	pool.addrs[1].active = 1
+
+	// WHEN-THEN
+	assert.Equal(t, egressAddrs[2], acquireAddr(t, pool, ""))
+	assert.Equal(t, egressAddrs[1], acquireAddr(t, pool, ""))
+}
+
+func TestEgressPoolStickyKeyIsStable(t *testing.T) {
+	// GIVEN
+	pool, now := newTestEgressPool(t, WithEgressStrategy(StickyKeyEgress))
+	first := acquireAddr(t, pool, "key:a")
+
+	// WHEN-THEN
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, acquireAddr(t, pool, "key:a"))
+	}
+
+	// the key is moved to another address while its address is excluded
+	_, excluded := pool.observe(&net.TCPAddr{IP: first.AsSlice()}, tooManyRequests(""))
+	require.True(t, excluded)
+	assert.NotEqual(t, first, acquireAddr(t, pool, "key:a"))
+
+	*now = now.Add(defaultEgressCooldown)
+	assert.Equal(t, first, acquireAddr(t, pool, "key:a"))
+}
+
+func TestEgressPoolStickyKeyFallsBackToClientIP(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t, WithEgressStrategy(StickyKeyEgress), WithEgressKeyHeader("X-Api-Key"))
+	r, _ := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	ctx := context.WithValue(context.Background(), dialInfoKey{}, &dialInfo{clientIP: net.IPv4(10, 0, 0, 1), request: r})
+
+	// WHEN-THEN
+	assert.Equal(t, "key:secret", pool.stickyKey(ctx))
+	r.Header.Del("X-Api-Key")
+	assert.Equal(t, "ip:10.0.0.1", pool.stickyKey(ctx))
+	assert.Equal(t, "", pool.stickyKey(context.Background()))
+}
+
+func TestEgressPoolExcludesRateLimitedAddress(t *testing.T) {
+	// GIVEN
+	pool, now := newTestEgressPool(t, WithEgressCooldown(10*time.Second))
+
+	// WHEN
+	stats, excluded := pool.observe(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, tooManyRequests("60"))
+
+	// THEN
+	require.True(t, excluded)
+	assert.Equal(t, egressAddrs[1], stats.Addr)
+	assert.Equal(t, now.Add(time.Minute), stats.ExcludedUntil)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	for i := 0; i < 4; i++ {
+		assert.NotEqual(t, egressAddrs[1], acquireAddr(t, pool, ""))
+	}
+	assert.Equal(t, uint64(1), pool.Stats()[1].Rejected)
+}
+
+func TestEgressPoolIgnoresOtherResponses(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t)
+
+	// WHEN
+	_, excluded := pool.observe(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, &http.Response{StatusCode: http.StatusServiceUnavailable})
+
+	// THEN
+	assert.False(t, excluded)
+}
+
+func TestEgressPoolExhausted(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t)
+	for _, addr := range egressAddrs {
+		_, excluded := pool.observe(&net.TCPAddr{IP: addr.AsSlice()}, &http.Response{StatusCode: http.StatusTeapot})
+		require.True(t, excluded)
+	}
+
+	// WHEN
+	_, err := pool.DialContext(context.Background(), "tcp", "192.0.2.10:443")
+
+	// THEN
+	assert.ErrorIs(t, err, errEgressExhausted)
+}
+
+func TestEgressPoolBindsLocalAddress(t *testing.T) {
+	// GIVEN
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	defer func() { _ = listener.Close() }()
+	pool, poolErr := NewEgressPool([]netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	require.NoError(t, poolErr)
+
+	// WHEN
+	conn, dialErr := pool.DialContext(context.Background(), "tcp", listener.Addr().String())
+	require.NoError(t, dialErr)
+
+	// THEN
+	assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+	assert.Equal(t, 1, pool.Stats()[0].Active)
+	require.NoError(t, conn.Close())
+	_ = conn.Close()
+	assert.Equal(t, 0, pool.Stats()[0].Active)
+	assert.Equal(t, uint64(1), pool.Stats()[0].Total)
+}
+
+// addrDialer records the egress address passed to the dialer in the context
+type addrDialer struct {
+	addr netip.Addr
+}
+
+func (d *addrDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	d.addr, _ = EgressAddrFromContext(ctx)
+	client, server := net.Pipe()
+	_ = server.Close()
+	return client, nil
+}
+
+func TestEgressPoolWrapsDialer(t *testing.T) {
+	// GIVEN
+	pool, _ := newTestEgressPool(t)
+	dialer := &addrDialer{}
+
+	// WHEN
+	conn, err := pool.wrap(dialer).DialContext(context.Background(), "tcp", "192.0.2.10:443")
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, egressAddrs[0], dialer.addr)
+	assert.Equal(t, 1, pool.Stats()[0].Active)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 0, pool.Stats()[0].Active)
+}
@@ -6,16 +6,21 @@
 package proxy
 
 import (
+	"context"
 	"crypto/elliptic"
 	"crypto/tls"
 	"errors"
+	"github.com/pmateusz/glove/internal/acl"
 	"github.com/pmateusz/glove/internal/ca"
 	"github.com/pmateusz/glove/internal/logging"
 	"github.com/pmateusz/glove/internal/runtime"
+	"github.com/pmateusz/glove/internal/urllib"
 	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"syscall"
 	"time"
 )
@@ -23,23 +28,102 @@ import (
 // TODO: improve error handling for closed connections and writes to closed connections
 
 type Engine struct {
-	logger zerolog.Logger
-	dialer *net.Dialer
-	tools  *netTools
+	// ctx is the parent of session contexts, it is cancelled when the engine is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	logger      zerolog.Logger
+	dialer      Dialer
+	dialTimeout time.Duration
+	tools       *netTools
+	http2Server *http2.Server
+	http2Conns  *http2ConnPool
 
 	clientConfig func(host string) (*tls.Config, error)
 	serverConfig func(host string) (*tls.Config, error)
 
 	defaultRule *Rule
 	ruleByHost  map[string]*Rule
+
+	clientIPResolver *urllib.ClientIPResolver
+	viaPseudonym     string
+	upstream         *UpstreamProxy
+	egress           *EgressPool
+	resolver         *Resolver
+	accessLog        bool
+}
+
+// lookupHost returns the addresses of the host using static hosts of its rule and the resolver, the resolver of the
+// system is used if the resolver is not configured
+func (e *Engine) lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	rule, hasRule := e.ruleByHost[host]
+	if !hasRule {
+		rule = e.defaultRule
+	}
+
+	if e.resolver != nil {
+		addrs, _, err := e.resolver.lookup(ctx, host, rule.Hosts)
+		return addrs, err
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// tlsServerName returns the name the certificate of the origin server is verified for, which is the host of the dialed
+// address unless the configuration sets the name
+func tlsServerName(config *tls.Config, host string) string {
+	if config.ServerName != "" {
+		return config.ServerName
+	}
+	serverName, _, splitErr := net.SplitHostPort(host)
+	if splitErr != nil {
+		return host
+	}
+	return serverName
 }
 
-func (e *Engine) dialTCP(host string) (net.Conn, error) {
-	return e.dialer.Dial("tcp", host)
+func (e *Engine) dialTCP(ctx context.Context, upstream *UpstreamProxy, host string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.dialTimeout)
+	defer cancel()
+
+	if upstream != nil {
+		return upstream.dial(ctx, e.dialer, e.lookupHost, host)
+	}
+	return e.dialer.DialContext(ctx, "tcp", host)
+}
+
+func (e *Engine) dialTLS(ctx context.Context, upstream *UpstreamProxy, host string, config *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.dialTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	var dialErr error
+	if upstream != nil {
+		conn, dialErr = upstream.dial(ctx, e.dialer, e.lookupHost, host)
+	} else {
+		conn, dialErr = e.dialer.DialContext(ctx, "tcp", host)
+	}
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = tlsServerName(config, host)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if handshakeErr := tlsConn.HandshakeContext(ctx); handshakeErr != nil {
+		_ = conn.Close()
+		return nil, handshakeErr
+	}
+	return tlsConn, nil
 }
 
-func (e *Engine) dialTLS(host string, config *tls.Config) (net.Conn, error) {
-	return tls.DialWithDialer(e.dialer, "tcp", host, config)
+func (e *Engine) dialUpstream(ctx context.Context, upstream *UpstreamProxy) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.dialTimeout)
+	defer cancel()
+
+	return upstream.dialProxy(ctx, e.dialer)
 }
 
 func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -61,13 +145,27 @@ func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	e.serve(s, r)
+}
+
+// Close cancels contexts of all sessions and interrupts their connections. Requests received afterwards are served
+// with contexts that are already cancelled, so the engine should be closed once the servers using it are shut down.
+func (e *Engine) Close() error {
+	e.cancel()
+	return nil
+}
+
+// serve handles the first request that opened the session and subsequent requests received on the client connection
+func (e *Engine) serve(s *session, r *http.Request) {
 	defer s.Close()
 
 	s.handle(r)
 	for !s.close {
+		stopReading := withConnContext(s.ctx, s.clientConn)
 		req, readErr := s.readRequest() // TODO: add timeout as it hangs if request doesn't end with /r/n/r/n
+		stopReading()
 		if readErr != nil {
-			if errors.Is(readErr, io.EOF) || errors.Is(readErr, syscall.ECONNRESET) {
+			if errors.Is(readErr, io.EOF) || errors.Is(readErr, syscall.ECONNRESET) || s.ctx.Err() != nil {
 				break
 			}
 
@@ -122,28 +220,79 @@ func NewEngine(opts ...EngineOption) *Engine {
 		}
 	}
 
+	configuredDialer := options.dialer
 	if options.dialer == nil {
 		options.dialer = &net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   defaultDialTimeout,
 			KeepAlive: 30 * time.Second,
 		}
 	}
 
+	if options.dialTimeout == 0 {
+		options.dialTimeout = defaultDialTimeout
+		if netDialer, ok := options.dialer.(*net.Dialer); ok && netDialer.Timeout > 0 {
+			// the Timeout of a *net.Dialer is used unless WithDialTimeout is set
+			options.dialTimeout = netDialer.Timeout
+		}
+	}
+
+	if options.egress != nil {
+		// the pool dials connections itself unless the dialer is set
+		options.dialer = options.egress.wrap(configuredDialer)
+	}
+
+	if options.resolver == nil && hasStaticHosts(options) {
+		// static hosts of rules are resolved even if the resolver is not configured
+		options.resolver, _ = NewResolver()
+	}
+	if options.resolver != nil {
+		options.dialer = &resolvingDialer{Dialer: options.dialer, resolver: options.resolver}
+	}
+
+	if options.viaPseudonym == "" {
+		options.viaPseudonym = defaultViaPseudonym
+	}
+
 	if options.defaultRule == nil {
 		options.defaultRule = &Rule{
 			Action: TunnelAction,
 		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Engine{
+		ctx:          ctx,
+		cancel:       cancel,
 		logger:       logger,
 		dialer:       options.dialer,
+		dialTimeout:  options.dialTimeout,
 		tools:        newNetTools(logger),
+		http2Server:  &http2.Server{},
+		http2Conns:   newHTTP2ConnPool(options.egress),
 		clientConfig: options.clientConfig,
 		serverConfig: options.serverConfig,
 		defaultRule:  options.defaultRule,
 		ruleByHost:   options.ruleByHost,
+
+		clientIPResolver: urllib.NewClientIPResolver(acl.NewTrie(options.trustedProxies...)),
+		viaPseudonym:     options.viaPseudonym,
+		upstream:         options.upstream,
+		egress:           options.egress,
+		resolver:         options.resolver,
+		accessLog:        options.accessLog,
+	}
+}
+
+func hasStaticHosts(options *EngineOptions) bool {
+	if options.defaultRule != nil && len(options.defaultRule.Hosts) > 0 {
+		return true
+	}
+	for _, rule := range options.ruleByHost {
+		if len(rule.Hosts) > 0 {
+			return true
+		}
 	}
+	return false
 }
 
 func newSelfSignedCA() (*ca.CA, error) {
@@ -8,18 +8,27 @@ package proxy
 import (
 	"crypto/tls"
 	"github.com/rs/zerolog"
-	"net"
+	"net/netip"
+	"time"
 )
 
 type EngineOptions struct {
-	logger *zerolog.Logger
-	dialer *net.Dialer
+	logger      *zerolog.Logger
+	dialer      Dialer
+	dialTimeout time.Duration
 
 	defaultRule *Rule
 	ruleByHost  map[string]*Rule
 
 	clientConfig func(host string) (*tls.Config, error)
 	serverConfig func(host string) (*tls.Config, error)
+
+	trustedProxies []netip.Prefix
+	viaPseudonym   string
+	upstream       *UpstreamProxy
+	egress         *EgressPool
+	resolver       *Resolver
+	accessLog      bool
 }
 
 func NewEngineOptions() *EngineOptions {
@@ -51,12 +60,21 @@ func WithDefaultRule(defaultRule *Rule) EngineOption {
 	}
 }
 
-func WithDialer(dialer *net.Dialer) EngineOption {
+// WithDialer sets the dialer used to connect to origin servers and upstream proxies.
+func WithDialer(dialer Dialer) EngineOption {
 	return func(opts *EngineOptions) {
 		opts.dialer = dialer
 	}
 }
 
+// WithDialTimeout limits the time to connect to the origin server, including the TLS handshake. By default, the
+// timeout of *net.Dialer passed using WithDialer is used or 30 seconds otherwise.
+func WithDialTimeout(timeout time.Duration) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.dialTimeout = timeout
+	}
+}
+
 func WithClientConfig(clientConfig func(string) (*tls.Config, error)) EngineOption {
 	return func(opts *EngineOptions) {
 		opts.clientConfig = clientConfig
@@ -68,3 +86,52 @@ func WithServerConfig(serverConfig func(string) (*tls.Config, error)) EngineOpti
 		opts.serverConfig = serverConfig
 	}
 }
+
+// WithTrustedProxies adds network prefixes of proxies allowed to pass the client's address in the Forwarded,
+// X-Forwarded-For and X-Real-IP headers.
+func WithTrustedProxies(prefixes ...netip.Prefix) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.trustedProxies = append(opts.trustedProxies, prefixes...)
+	}
+}
+
+// WithViaPseudonym sets the name of the proxy sent in the Via header by rules that append or replace forwarding
+// headers.
+func WithViaPseudonym(pseudonym string) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.viaPseudonym = pseudonym
+	}
+}
+
+// WithUpstreamProxy sets the parent proxy used to reach origin servers by rules that don't set their own upstream
+// proxy.
+func WithUpstreamProxy(upstream *UpstreamProxy) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.upstream = upstream
+	}
+}
+
+// WithResolver resolves host names of origin servers and upstream proxies using the resolver instead of the dialer.
+func WithResolver(resolver *Resolver) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.resolver = resolver
+	}
+}
+
+// WithEgressPool binds connections to origin servers and upstream proxies to the local addresses of the pool. The
+// engine reports responses to the pool, so rate limited addresses are excluded. Connections are opened using the
+// dialer set by WithDialer, *net.Dialer is copied with the local address set, whereas other dialers read the address
+// using EgressAddrFromContext.
+func WithEgressPool(pool *EgressPool) EngineOption {
+	return func(opts *EngineOptions) {
+		opts.egress = pool
+	}
+}
+
+// WithAccessLog logs the access message for every request with the method, the host, the path, the status of the
+// response and loggable attributes set by handlers.
+func WithAccessLog() EngineOption {
+	return func(opts *EngineOptions) {
+		opts.accessLog = true
+	}
+}
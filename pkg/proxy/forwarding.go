@@ -0,0 +1,123 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/pmateusz/glove/internal/urllib"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultViaPseudonym = "glove"
+
+// ForwardingPolicy controls the X-Forwarded-For, Forwarded and Via headers of requests sent to the origin server.
+type ForwardingPolicy int32
+
+const (
+	// PreserveForwarding sends the headers received from the client unchanged.
+	PreserveForwarding ForwardingPolicy = iota
+	// AppendForwarding adds the proxy's hop to the headers received from the client.
+	AppendForwarding
+	// ReplaceForwarding discards the headers received from the client and sends only the proxy's hop.
+	ReplaceForwarding
+	// StripForwarding removes the headers, so the origin server gets no indication a proxy was involved.
+	StripForwarding
+)
+
+func ParseForwardingPolicy(policyName string) (ForwardingPolicy, error) {
+	if policyName == "" {
+		return PreserveForwarding, nil
+	}
+
+	switch strings.ToUpper(policyName) {
+	case "PRESERVE":
+		return PreserveForwarding, nil
+	case "APPEND":
+		return AppendForwarding, nil
+	case "REPLACE":
+		return ReplaceForwarding, nil
+	case "STRIP":
+		return StripForwarding, nil
+	default:
+		return 0, fmt.Errorf("failed to parse forwarding policy %q, supported policies are: preserve, append, replace or strip", policyName)
+	}
+}
+
+func applyForwardingPolicy(policy ForwardingPolicy, viaPseudonym string, r *http.Request) {
+	switch policy {
+	case AppendForwarding:
+		appendHeader(r.Header, "X-Forwarded-For", forwardedFor(r))
+		appendHeader(r.Header, "Forwarded", forwarded(r))
+		appendHeader(r.Header, "Via", via(r, viaPseudonym))
+	case ReplaceForwarding:
+		r.Header.Set("X-Forwarded-For", forwardedFor(r))
+		r.Header.Set("Forwarded", forwarded(r))
+		r.Header.Set("Via", via(r, viaPseudonym))
+	case StripForwarding:
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("Forwarded")
+		r.Header.Del("Via")
+	}
+}
+
+// appendHeader joins the value with values of the header received from the client, so the header is sent in a single
+// line and the proxy's hop is the last item of the list
+func appendHeader(header http.Header, name, value string) {
+	values := header.Values(name)
+	if len(values) == 0 {
+		header.Set(name, value)
+		return
+	}
+	header.Set(name, strings.Join(append(values, value), ", "))
+}
+
+func forwardedFor(r *http.Request) string {
+	ip := urllib.RemoteIp(r)
+	if ip == nil {
+		return "unknown"
+	}
+	return ip.String()
+}
+
+func forwarded(r *http.Request) string {
+	var b strings.Builder
+
+	b.WriteString("for=")
+	ip := urllib.RemoteIp(r)
+	switch {
+	case ip == nil:
+		b.WriteString("unknown")
+	case ip.To4() == nil:
+		b.WriteString(`"[` + ip.String() + `]"`)
+	default:
+		b.WriteString(ip.String())
+	}
+
+	if r.Host != "" {
+		b.WriteString(";host=")
+		b.WriteString(strconv.Quote(r.Host))
+	}
+
+	if r.URL != nil && r.URL.Scheme != "" {
+		b.WriteString(";proto=")
+		b.WriteString(r.URL.Scheme)
+	}
+
+	return b.String()
+}
+
+// via returns the Via header entry of the proxy, HTTP/2 and later versions are identified by the major version only
+func via(r *http.Request, pseudonym string) string {
+	protocol := strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+	if r.ProtoMajor == 0 {
+		protocol = "1.1"
+	} else if r.ProtoMajor >= 2 {
+		protocol = strconv.Itoa(r.ProtoMajor)
+	}
+	return protocol + " " + pseudonym
+}
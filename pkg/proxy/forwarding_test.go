@@ -0,0 +1,107 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newForwardedRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("Forwarded", "for=198.51.100.1")
+	r.Header.Set("Via", "1.0 upstream")
+	return r
+}
+
+func TestPreserveForwardingHeaders(t *testing.T) {
+	// GIVEN
+	r := newForwardedRequest("203.0.113.7:1234")
+
+	// WHEN
+	applyForwardingPolicy(PreserveForwarding, "glove", r)
+
+	// THEN
+	assert.Equal(t, "198.51.100.1", r.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "for=198.51.100.1", r.Header.Get("Forwarded"))
+	assert.Equal(t, "1.0 upstream", r.Header.Get("Via"))
+}
+
+func TestAppendForwardingHeaders(t *testing.T) {
+	// GIVEN
+	r := newForwardedRequest("203.0.113.7:1234")
+
+	// WHEN
+	applyForwardingPolicy(AppendForwarding, "glove", r)
+
+	// THEN
+	assert.Equal(t, []string{"198.51.100.1, 203.0.113.7"}, r.Header.Values("X-Forwarded-For"))
+	assert.Equal(t, []string{`for=198.51.100.1, for=203.0.113.7;host="example.com";proto=http`}, r.Header.Values("Forwarded"))
+	assert.Equal(t, []string{"1.0 upstream, 1.1 glove"}, r.Header.Values("Via"))
+}
+
+func TestReplaceForwardingHeaders(t *testing.T) {
+	// GIVEN
+	r := newForwardedRequest("[2001:db8::1]:1234")
+
+	// WHEN
+	applyForwardingPolicy(ReplaceForwarding, "edge", r)
+
+	// THEN
+	assert.Equal(t, "2001:db8::1", r.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, `for="[2001:db8::1]";host="example.com";proto=http`, r.Header.Get("Forwarded"))
+	assert.Equal(t, "1.1 edge", r.Header.Get("Via"))
+}
+
+func TestViaIdentifiesProtocolVersion(t *testing.T) {
+	for expected, version := range map[string][2]int{
+		"1.0 glove": {1, 0},
+		"1.1 glove": {1, 1},
+		"2 glove":   {2, 0},
+		"3 glove":   {3, 0},
+	} {
+		t.Run(expected, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+			r.ProtoMajor, r.ProtoMinor = version[0], version[1]
+
+			assert.Equal(t, expected, via(r, "glove"))
+		})
+	}
+}
+
+func TestStripForwardingHeaders(t *testing.T) {
+	// GIVEN
+	r := newForwardedRequest("203.0.113.7:1234")
+
+	// WHEN
+	applyForwardingPolicy(StripForwarding, "glove", r)
+
+	// THEN
+	assert.Empty(t, r.Header.Values("X-Forwarded-For"))
+	assert.Empty(t, r.Header.Values("Forwarded"))
+	assert.Empty(t, r.Header.Values("Via"))
+}
+
+func TestParseForwardingPolicy(t *testing.T) {
+	for name, expected := range map[string]ForwardingPolicy{
+		"":         PreserveForwarding,
+		"preserve": PreserveForwarding,
+		"Append":   AppendForwarding,
+		"REPLACE":  ReplaceForwarding,
+		"strip":    StripForwarding,
+	} {
+		policy, err := ParseForwardingPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseForwardingPolicy("hide")
+	assert.Error(t, err)
+}
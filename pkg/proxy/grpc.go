@@ -0,0 +1,118 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// GRPCCode is the status code of a gRPC call, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+type GRPCCode uint32
+
+const (
+	GRPCOK GRPCCode = iota
+	GRPCCanceled
+	GRPCUnknown
+	GRPCInvalidArgument
+	GRPCDeadlineExceeded
+	GRPCNotFound
+	GRPCAlreadyExists
+	GRPCPermissionDenied
+	GRPCResourceExhausted
+	GRPCFailedPrecondition
+	GRPCAborted
+	GRPCOutOfRange
+	GRPCUnimplemented
+	GRPCInternal
+	GRPCUnavailable
+	GRPCDataLoss
+	GRPCUnauthenticated
+)
+
+var grpcCodeNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+func (c GRPCCode) String() string {
+	if int(c) < len(grpcCodeNames) {
+		return grpcCodeNames[c]
+	}
+	return fmt.Sprintf("CODE(%d)", uint32(c))
+}
+
+// isGRPC reports whether the request is a gRPC call, the content type can be followed by the message encoding, e.g.,
+// application/grpc+proto
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// newGRPCResponse returns the trailers-only response that ends the gRPC call with the status
+func newGRPCResponse(code GRPCCode, message string, r *http.Request) *http.Response {
+	resp := newHTTP11Response(http.StatusOK, r)
+	resp.Header = make(http.Header)
+	resp.Header.Set("Content-Type", "application/grpc")
+	resp.Header.Set("Grpc-Status", strconv.FormatUint(uint64(code), 10))
+	if message != "" {
+		resp.Header.Set("Grpc-Message", encodeGRPCMessage(message))
+	}
+	return resp
+}
+
+// grpcStatus reads the status from the trailers of the response or from the headers of a trailers-only response
+func grpcStatus(resp *http.Response) (GRPCCode, string, bool) {
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+
+	code, parseErr := strconv.ParseUint(status, 10, 32)
+	if parseErr != nil {
+		return 0, "", false
+	}
+	return GRPCCode(code), decodeGRPCMessage(message), true
+}
+
+// encodeGRPCMessage percent-encodes characters outside printable ASCII as required by the gRPC protocol
+func encodeGRPCMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		if b := message[i]; b >= ' ' && b <= '~' && b != '%' {
+			builder.WriteByte(b)
+		} else {
+			_, _ = fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func decodeGRPCMessage(message string) string {
+	if decoded, err := url.PathUnescape(message); err == nil {
+		return decoded
+	}
+	return message
+}
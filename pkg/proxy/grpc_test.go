@@ -0,0 +1,69 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestIsGRPC(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/grpc+json":  true,
+		"application/grpc-web":   false,
+		"application/json":       false,
+		"":                       false,
+	} {
+		r := &http.Request{Header: http.Header{"Content-Type": {contentType}}}
+		assert.Equal(t, expected, isGRPC(r), contentType)
+	}
+}
+
+func TestGRPCMessageEncoding(t *testing.T) {
+	message := "50% done: zażółć\n"
+
+	encoded := encodeGRPCMessage(message)
+
+	assert.Equal(t, "50%25 done: za%C5%BC%C3%B3%C5%82%C4%87%0A", encoded)
+	assert.Equal(t, message, decodeGRPCMessage(encoded))
+}
+
+func TestGRPCStatusPrefersTrailers(t *testing.T) {
+	// GIVEN
+	resp := newGRPCResponse(GRPCUnavailable, "headers", nil)
+	resp.Trailer = http.Header{"Grpc-Status": {"0"}}
+
+	// WHEN
+	code, message, ok := grpcStatus(resp)
+
+	// THEN
+	assert.True(t, ok)
+	assert.Equal(t, GRPCOK, code)
+	assert.Empty(t, message)
+}
+
+func TestGRPCStatusOfTrailersOnlyResponse(t *testing.T) {
+	// GIVEN
+	resp := newGRPCResponse(GRPCPermissionDenied, "method is blocked", nil)
+
+	// WHEN
+	code, message, ok := grpcStatus(resp)
+
+	// THEN
+	assert.True(t, ok)
+	assert.Equal(t, GRPCPermissionDenied, code)
+	assert.Equal(t, "PERMISSION_DENIED", code.String())
+	assert.Equal(t, "method is blocked", message)
+}
+
+func TestGRPCStatusIsMissing(t *testing.T) {
+	_, _, ok := grpcStatus(newHTTP11Response(http.StatusBadGateway, nil))
+
+	assert.False(t, ok)
+}
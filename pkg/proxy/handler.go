@@ -5,4 +5,26 @@
 
 package proxy
 
+import "time"
+
 type Handler func(c *Context)
+
+// Hook observes the request or the response at a given phase. Unlike handlers, hooks don't call Next, all hooks of
+// the phase run one after another.
+type Hook func(c *Context)
+
+// ErrorHook is called when the request fails to reach the origin server. The response sent to the client is already
+// set in the context and can be replaced.
+type ErrorHook func(c *Context, err error)
+
+// TunnelCloseHook is called once both sides of the tunnel are closed.
+type TunnelCloseHook func(c *Context, stats TunnelStats)
+
+// TunnelStats summarizes the tunnel between the client and the origin server.
+type TunnelStats struct {
+	// BytesSent were copied from the client to the origin server
+	BytesSent int64
+	// BytesReceived were copied from the origin server to the client
+	BytesReceived int64
+	Duration      time.Duration
+}
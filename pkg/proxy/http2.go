@@ -0,0 +1,384 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"github.com/pmateusz/glove/internal/urllib"
+	"golang.org/x/net/http2"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// http2IdleConnTimeout closes connections to origin servers that have no active streams
+	http2IdleConnTimeout = 90 * time.Second
+	// http2ReadIdleTimeout sends the ping frame to verify the connection to the origin server is alive if no frames
+	// were received
+	http2ReadIdleTimeout = 30 * time.Second
+)
+
+// http2ConnectionHeaders are not allowed in HTTP/2 responses, see RFC 9113 8.2.2
+var http2ConnectionHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// withHTTP2 advertises h2 and http/1.1 using ALPN unless the TLS configuration of the rule sets its own protocols or
+// the rule disables HTTP/2
+func withHTTP2(config *tls.Config, disabled bool) *tls.Config {
+	if disabled || len(config.NextProtos) > 0 {
+		return config
+	}
+
+	config = config.Clone()
+	config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	return config
+}
+
+// serveHTTP2 handles streams of the HTTP/2 client connection until the client closes the connection. Each stream is
+// handled by its own session, so handlers receive one Context per stream. Streams share connections to the origin
+// server, which are used by one stream at a time.
+func (s *session) serveHTTP2() {
+	s.serverConns = &serverConnPool{}
+	if s.serverConn != nil {
+		s.serverConns.release(s.serverConn, s.serverReader, s.serverEgressKey)
+		s.serverConn, s.serverReader = nil, nil
+	}
+
+	defer withConnContext(s.ctx, s.clientConn)()
+	s.engine.http2Server.ServeConn(s.clientConn, &http2.ServeConnOpts{
+		Context:    s.ctx,
+		BaseConfig: &http.Server{ErrorLog: log.New(s.logger, "", 0)},
+		Handler:    http.HandlerFunc(s.serveStream),
+	})
+	s.close = true
+}
+
+func (s *session) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.RemoteAddr = s.proxyRemoteAddr
+	r.URL.Scheme = s.scheme
+	r.URL.Host = s.serverRemoteAddr
+
+	stream := s.newStream(r)
+	egressKey := stream.egressKey(r)
+	if egressKey != stream.serverEgressKey {
+		// the shared connection was opened for another key of the egress pool
+		stream.serverHTTP2 = nil
+	}
+	stream.serverConn, stream.serverReader = s.serverConns.acquire(egressKey)
+	stream.serverEgressKey = egressKey
+	stream.writeResponse = func(resp *http.Response) error {
+		return writeHTTP2Response(w, resp)
+	}
+	stream.handle(r)
+
+	if stream.serverConn != nil {
+		if stream.close {
+			s.tools.CloseConn(stream.serverConn)
+		} else {
+			s.serverConns.release(stream.serverConn, stream.serverReader, stream.serverEgressKey)
+		}
+	}
+}
+
+// newStream returns the session that handles the stream of the HTTP/2 client connection. The session is cancelled
+// once the stream is reset or the client connection is closed.
+func (s *session) newStream(r *http.Request) *session {
+	return &session{
+		logger:               s.logger,
+		tools:                s.tools,
+		engine:               s.engine,
+		rule:                 s.rule,
+		ctx:                  r.Context(),
+		scheme:               s.scheme,
+		proxyRemoteAddr:      s.proxyRemoteAddr,
+		clientConn:           s.clientConn,
+		serverRemoteAddr:     s.serverRemoteAddr,
+		serverHost:           s.serverHost,
+		upstreamAddr:         s.upstreamAddr,
+		serverPlaintext:      s.serverPlaintext,
+		serverHTTP2:          s.serverHTTP2,
+		serverEgressKey:      s.serverEgressKey,
+		overrideAction:       s.overrideAction,
+		overrideServerConfig: s.overrideServerConfig,
+		attributes:           s.attributes,
+	}
+}
+
+// writeHTTP2Response sends the response to the stream. The body is flushed as it is read from the origin server, so
+// streaming responses are not delayed.
+func writeHTTP2Response(w http.ResponseWriter, resp *http.Response) error {
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	for _, name := range http2ConnectionHeaders {
+		header.Del(name)
+	}
+	if resp.ContentLength >= 0 && header.Get("Content-Length") == "" && resp.Body != nil && resp.Body != http.NoBody {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		if copyErr := copyFlush(w, resp.Body); copyErr != nil {
+			return copyErr
+		}
+	}
+
+	// trailers are known once the body is read
+	for name, values := range resp.Trailer {
+		header[http.TrailerPrefix+name] = values
+	}
+	return nil
+}
+
+func copyFlush(w http.ResponseWriter, body io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// http2Conn is the connection to the origin server multiplexing requests of many sessions
+type http2Conn struct {
+	*http2.ClientConn
+	localAddr net.Addr
+}
+
+// http2ConnKey identifies connections to the origin server that can be shared by sessions
+type http2ConnKey struct {
+	rule *Rule
+	addr string
+	// serverName is the name the certificate of the origin server was verified for, many hosts can be directed to the
+	// same address
+	serverName string
+	upstream   *UpstreamProxy
+	// config is the TLS configuration set by handlers for the session, connections made using other configurations
+	// are not shared
+	config *tls.Config
+	// egressKey is the key the egress pool selected the local address of the connection by
+	egressKey string
+}
+
+// http2ConnPool shares HTTP/2 connections to origin servers between sessions. Connections are closed by the transport
+// once they are idle.
+type http2ConnPool struct {
+	transport *http2.Transport
+	// egress excludes connections from local addresses that are rate limited
+	egress *EgressPool
+
+	mu    sync.Mutex
+	conns map[http2ConnKey][]*http2Conn
+}
+
+func newHTTP2ConnPool(egress *EgressPool) *http2ConnPool {
+	// the idle timeout is read from the HTTP/1.1 transport
+	transport, _ := http2.ConfigureTransports(&http.Transport{IdleConnTimeout: http2IdleConnTimeout})
+	transport.ReadIdleTimeout = http2ReadIdleTimeout
+
+	return &http2ConnPool{
+		transport: transport,
+		egress:    egress,
+		conns:     make(map[http2ConnKey][]*http2Conn),
+	}
+}
+
+// get returns the connection that can take a new request and forgets connections that are closed or opened from the
+// local address excluded by the egress pool. Forgotten connections finish their requests and are closed once idle.
+func (p *http2ConnPool) get(key http2ConnKey) *http2Conn {
+	if !p.shared(key) {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var available *http2Conn
+	open := p.conns[key][:0]
+	for _, conn := range p.conns[key] {
+		if conn.State().Closed || (p.egress != nil && p.egress.excluded(conn.localAddr)) {
+			continue
+		}
+		open = append(open, conn)
+		if available == nil && conn.CanTakeNewRequest() {
+			available = conn
+		}
+	}
+
+	if len(open) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = open
+	}
+	return available
+}
+
+// add returns the HTTP/2 connection, which is shared with other sessions unless the key is not shared
+func (p *http2ConnPool) add(key http2ConnKey, conn net.Conn) (*http2Conn, error) {
+	clientConn, clientConnErr := p.transport.NewClientConn(conn)
+	if clientConnErr != nil {
+		return nil, clientConnErr
+	}
+
+	http2Conn := &http2Conn{ClientConn: clientConn, localAddr: conn.LocalAddr()}
+	if !p.shared(key) {
+		return http2Conn, nil
+	}
+	p.mu.Lock()
+	p.conns[key] = append(p.conns[key], http2Conn)
+	p.mu.Unlock()
+	return http2Conn, nil
+}
+
+// shared reports whether connections of the key are shared. The egress pool selects the address for every connection
+// unless the address is selected by the sticky key, so connections are not shared by other strategies.
+func (p *http2ConnPool) shared(key http2ConnKey) bool {
+	return p.egress == nil || key.egressKey != ""
+}
+
+// dialServerTLS connects to the origin server of the intercepted connection. HTTP/2 is offered to the origin server
+// unless the rule disables it, and HTTP/2 connections opened by other sessions are reused.
+func (s *session) dialServerTLS(r *http.Request, config *tls.Config) error {
+	addr := s.dialAddr(r)
+	key := http2ConnKey{
+		rule:       s.rule,
+		addr:       addr,
+		serverName: tlsServerName(config, addr),
+		upstream:   s.upstreamProxy(),
+		config:     s.overrideServerConfig,
+		egressKey:  s.egressKey(r),
+	}
+	if !s.rule.DisableServerHTTP2 && !isWebsocketUpgrade(r) {
+		if conn := s.engine.http2Conns.get(key); conn != nil {
+			s.serverHTTP2 = conn
+			s.serverEgressKey = key.egressKey
+			return nil
+		}
+		config = withHTTP2(config, false)
+	}
+
+	ctx, stopWatching := s.dialContext(r)
+	serverConn, dialErr := s.engine.dialTLS(ctx, key.upstream, key.addr, config)
+	stopWatching()
+	if dialErr != nil {
+		return dialErr
+	}
+
+	if tlsConn, ok := serverConn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		conn, addErr := s.engine.http2Conns.add(key, serverConn)
+		if addErr != nil {
+			_ = serverConn.Close()
+			return addErr
+		}
+		s.serverHTTP2 = conn
+		return nil
+	}
+
+	s.serverConn = serverConn
+	s.serverReader = bufio.NewReader(serverConn)
+	return nil
+}
+
+// roundTripHTTP2 sends the request using the HTTP/2 connection to the origin server. The request is cancelled if the
+// client disconnects or the session is closed.
+func (s *session) roundTripHTTP2(r *http.Request) *http.Response {
+	serverRequest := r.WithContext(s.requestCtx)
+	// the client closing its connection must not close the connection shared with other sessions
+	serverRequest.Close = false
+
+	resp, roundTripErr := s.serverHTTP2.RoundTrip(serverRequest)
+	if roundTripErr != nil {
+		s.logger.Info().Err(roundTripErr).Msg("round-trip")
+		s.err = roundTripErr
+		s.serverHTTP2 = nil
+		return newHTTP11Response(http.StatusBadGateway, r)
+	}
+
+	urllib.RemoveHopByHopHeaders(resp.Header)
+	s.observeEgress(s.serverHTTP2.localAddr, resp)
+	return resp
+}
+
+type idleServerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// egressKey is the key the egress pool selected the local address of the connection by
+	egressKey string
+}
+
+// serverConnPool keeps idle connections to the origin server shared by streams of the HTTP/2 client connection
+type serverConnPool struct {
+	mu     sync.Mutex
+	idle   []idleServerConn
+	closed bool
+}
+
+// acquire returns the idle connection opened for the key of the egress pool
+func (p *serverConnPool) acquire(egressKey string) (net.Conn, *bufio.Reader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		if idle := p.idle[i]; idle.egressKey == egressKey {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return idle.conn, idle.reader
+		}
+	}
+	return nil, nil
+}
+
+func (p *serverConnPool) release(conn net.Conn, reader *bufio.Reader, egressKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleServerConn{conn: conn, reader: reader, egressKey: egressKey})
+}
+
+func (p *serverConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, idle := range p.idle {
+		_ = idle.conn.Close()
+	}
+	p.idle = nil
+}
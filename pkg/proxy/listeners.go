@@ -0,0 +1,85 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/pmateusz/glove/internal/netutil"
+	"github.com/rs/zerolog"
+	"net"
+	"sync"
+)
+
+// listenerGroup tracks listeners served by a front-end, so they can be closed together
+type listenerGroup struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+	// done is closed once the group is closed, so listeners waiting to retry the accept error stop
+	done chan struct{}
+}
+
+func (g *listenerGroup) track(l net.Listener) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	if g.listeners == nil {
+		g.listeners = make(map[net.Listener]struct{})
+		g.done = make(chan struct{})
+	}
+	g.listeners[l] = struct{}{}
+	return true
+}
+
+func (g *listenerGroup) untrack(l net.Listener) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.listeners, l)
+}
+
+func (g *listenerGroup) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.closed
+}
+
+// serve accepts connections until the listener is closed, closedErr is returned if the group was closed. Other accept
+// errors are retried.
+func (g *listenerGroup) serve(logger zerolog.Logger, l net.Listener, closedErr error, handle func(conn net.Conn)) error {
+	if !g.track(l) {
+		return closedErr
+	}
+	defer g.untrack(l)
+
+	acceptErr := netutil.AcceptLoop(logger, l, g.done, func(conn net.Conn) {
+		go handle(conn)
+	})
+	if g.isClosed() {
+		return closedErr
+	}
+	return acceptErr
+}
+
+func (g *listenerGroup) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.closed && g.done != nil {
+		close(g.done)
+	}
+	g.closed = true
+	var closeErr error
+	for l := range g.listeners {
+		if err := l.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
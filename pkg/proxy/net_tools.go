@@ -25,6 +25,21 @@ var (
 	errNotSupported = errors.New("runtime: not supported")
 )
 
+// proxyProtocolAddr returns the address of the load balancer for connections accepted using the PROXY protocol
+func proxyProtocolAddr(conn net.Conn) net.Addr {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ ProxyAddr() net.Addr }:
+			return c.ProxyAddr()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
 type netTools struct {
 	logger zerolog.Logger
 }
@@ -35,8 +50,9 @@ func newNetTools(logger zerolog.Logger) *netTools {
 	}
 }
 
-func (t *netTools) Copy(dest net.Conn, source net.Conn) {
-	if nBytes, err := io.Copy(dest, source); err != nil {
+func (t *netTools) Copy(dest net.Conn, source net.Conn) int64 {
+	nBytes, err := io.Copy(dest, source)
+	if err != nil {
 		t.logger.Info().
 			Err(err).
 			Int64("bytesWritten", nBytes).
@@ -44,23 +60,27 @@ func (t *netTools) Copy(dest net.Conn, source net.Conn) {
 			Str("destAddr", dest.RemoteAddr().String()).
 			Msg("copy")
 	}
+	return nBytes
 }
 
-func (t *netTools) Pipe(left, right net.Conn) {
+// Pipe copies bytes in both directions until both connections are closed and returns the number of bytes written to
+// each connection
+func (t *netTools) Pipe(left, right net.Conn) (leftBytes, rightBytes int64) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		t.Copy(left, right)
+		leftBytes = t.Copy(left, right)
 	}()
 
 	go func() {
 		defer wg.Done()
-		t.Copy(right, left)
+		rightBytes = t.Copy(right, left)
 	}()
 
 	wg.Wait()
+	return
 }
 
 func (t *netTools) Hijack(w http.ResponseWriter) (net.Conn, error) {
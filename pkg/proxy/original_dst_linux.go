@@ -0,0 +1,71 @@
+//go:build linux
+
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is the value of SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST socket options defined by netfilter
+const soOriginalDst = 80
+
+// OriginalDestination returns the destination of a connection redirected using the iptables REDIRECT or DNAT target.
+func OriginalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	rawConn, rawErr := syscallConn(conn)
+	if rawErr != nil {
+		return nil, rawErr
+	}
+
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	isIPv4 := localAddr == nil || localAddr.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if isIPv4 {
+			// sockaddr_in fits into the ipv6_mreq structure
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+			return
+		}
+
+		// sockaddr_in6 is the first member of the ip6_mtuinfo structure
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// the port is stored in the network byte order
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		addr = &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if sockErr != nil {
+		return nil, &net.OpError{Op: "getsockopt", Net: "tcp", Addr: conn.LocalAddr(), Err: sockErr}
+	}
+
+	if localAddr != nil && addr.IP.Equal(localAddr.IP) && addr.Port == localAddr.Port {
+		return nil, errNoOriginalDestination
+	}
+	return addr, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"net"
+)
+
+// OriginalDestination returns the destination of a connection redirected using the iptables REDIRECT or DNAT target.
+// The lookup is supported on Linux only.
+func OriginalDestination(_ net.Conn) (*net.TCPAddr, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,441 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultFallbackDelay is the time the dialer waits for a connection to an address of the preferred family before
+// it starts connecting to the other family, see RFC 8305
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// defaultCacheSize is the number of hosts kept in the cache before the least recently used host is evicted
+const defaultCacheSize = 10000
+
+// IPPreference selects the addresses of the resolved host the proxy connects to and the order they are tried in.
+type IPPreference int32
+
+const (
+	// AnyIP connects to the addresses in the order returned by the resolver.
+	AnyIP IPPreference = iota
+	// PreferIPv4 connects to IPv4 addresses first and falls back to IPv6 addresses.
+	PreferIPv4
+	// PreferIPv6 connects to IPv6 addresses first and falls back to IPv4 addresses.
+	PreferIPv6
+	// IPv4Only connects to IPv4 addresses only.
+	IPv4Only
+	// IPv6Only connects to IPv6 addresses only.
+	IPv6Only
+)
+
+func ParseIPPreference(preferenceName string) (IPPreference, error) {
+	if preferenceName == "" {
+		return AnyIP, nil
+	}
+
+	switch strings.ToUpper(strings.ReplaceAll(preferenceName, "-", "")) {
+	case "ANY":
+		return AnyIP, nil
+	case "PREFERIPV4":
+		return PreferIPv4, nil
+	case "PREFERIPV6":
+		return PreferIPv6, nil
+	case "IPV4ONLY":
+		return IPv4Only, nil
+	case "IPV6ONLY":
+		return IPv6Only, nil
+	default:
+		return 0, fmt.Errorf("failed to parse IP preference %q, supported preferences are: any, prefer-ipv4, prefer-ipv6, ipv4-only or ipv6-only", preferenceName)
+	}
+}
+
+type ResolverOptions struct {
+	addr          string
+	hosts         map[string][]netip.Addr
+	cacheTTL      time.Duration
+	cacheSize     int
+	preference    IPPreference
+	fallbackDelay time.Duration
+}
+
+type ResolverOption func(opts *ResolverOptions) error
+
+// WithResolverAddr sets the address of the DNS server queried instead of the servers configured in the system. The
+// port defaults to 53.
+func WithResolverAddr(addr string) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		if _, _, splitErr := net.SplitHostPort(addr); splitErr != nil {
+			addr = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), "53")
+		}
+		if _, parseErr := netip.ParseAddrPort(addr); parseErr != nil {
+			return fmt.Errorf("failed to parse the resolver address %q", addr)
+		}
+		opts.addr = addr
+		return nil
+	}
+}
+
+// WithStaticHost resolves the host to the addresses without querying the DNS server, like an entry in /etc/hosts.
+func WithStaticHost(host string, addrs ...netip.Addr) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		if len(addrs) == 0 {
+			return fmt.Errorf("static host %q requires at least one address", host)
+		}
+		opts.hosts[normalizeHost(host)] = addrs
+		return nil
+	}
+}
+
+// WithCacheTTL keeps the addresses of resolved hosts for the time. The TTL of DNS records is not known to the
+// resolver, so the time is used even if records expire earlier, and it should not exceed the TTLs of the records of
+// hosts that change addresses. Lookup errors are not cached. The cache is disabled by default.
+func WithCacheTTL(ttl time.Duration) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		opts.cacheTTL = ttl
+		return nil
+	}
+}
+
+// WithCacheSize limits the number of hosts kept in the cache, the least recently used host is evicted once the limit
+// is reached. The size defaults to 10000.
+func WithCacheSize(size int) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		if size < 1 {
+			return fmt.Errorf("cache size %d must be positive", size)
+		}
+		opts.cacheSize = size
+		return nil
+	}
+}
+
+// WithIPPreference sets the family of addresses the proxy connects to first or exclusively.
+func WithIPPreference(preference IPPreference) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		opts.preference = preference
+		return nil
+	}
+}
+
+// WithFallbackDelay sets the time the proxy waits for a connection to an address of the preferred family before it
+// starts connecting to an address of the other family in parallel. The delay defaults to 300 milliseconds. A negative
+// delay disables Happy Eyeballs, so the addresses are tried one after another.
+func WithFallbackDelay(delay time.Duration) ResolverOption {
+	return func(opts *ResolverOptions) error {
+		opts.fallbackDelay = delay
+		return nil
+	}
+}
+
+type resolverEntry struct {
+	name      string
+	addrs     []netip.Addr
+	expiresAt time.Time
+}
+
+// Resolver translates host names of origin servers and upstream proxies to IP addresses before the engine connects
+// to them. Static hosts of the rule take precedence over static hosts of the resolver, which take precedence over
+// the cache and the DNS server.
+type Resolver struct {
+	options  ResolverOptions
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	// lru orders entries of the cache from the most recently used
+	lru *list.List
+	now func() time.Time
+}
+
+func NewResolver(opts ...ResolverOption) (*Resolver, error) {
+	options := ResolverOptions{
+		hosts:         make(map[string][]netip.Addr),
+		cacheSize:     defaultCacheSize,
+		fallbackDelay: defaultFallbackDelay,
+	}
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+
+	resolver := net.DefaultResolver
+	if options.addr != "" {
+		var dialer net.Dialer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, options.addr)
+			},
+		}
+	}
+
+	return &Resolver{
+		options:  options,
+		resolver: resolver,
+		cache:    make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}, nil
+}
+
+// LookupNetIP returns the addresses of the host filtered and ordered according to the IP preference.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, _, err := r.lookup(ctx, host, nil)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := r.partition(addrs)
+	return append(primaries, fallbacks...), nil
+}
+
+// lookup returns the addresses of the host and the source they were read from
+func (r *Resolver) lookup(ctx context.Context, host string, ruleHosts map[string][]netip.Addr) ([]netip.Addr, string, error) {
+	name := normalizeHost(host)
+	if addrs, ok := ruleHosts[name]; ok {
+		return addrs, "rule", nil
+	}
+	if addrs, ok := r.options.hosts[name]; ok {
+		return addrs, "static", nil
+	}
+
+	if r.options.cacheTTL > 0 {
+		if addrs, ok := r.cached(name); ok {
+			return addrs, "cache", nil
+		}
+	}
+
+	network := "ip"
+	switch r.options.preference {
+	case IPv4Only:
+		network = "ip4"
+	case IPv6Only:
+		network = "ip6"
+	}
+
+	addrs, lookupErr := r.resolver.LookupNetIP(ctx, network, name)
+	if lookupErr != nil {
+		return nil, "", lookupErr
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+
+	if r.options.cacheTTL > 0 {
+		r.store(name, addrs, r.now().Add(r.options.cacheTTL))
+	}
+	return addrs, "dns", nil
+}
+
+// cached returns the addresses of the host unless they expired, the expired entry is removed
+func (r *Resolver) cached(name string) ([]netip.Addr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.cache[name]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*resolverEntry)
+	if !r.now().Before(entry.expiresAt) {
+		r.lru.Remove(element)
+		delete(r.cache, name)
+		return nil, false
+	}
+	r.lru.MoveToFront(element)
+	return entry.addrs, true
+}
+
+// store adds the addresses of the host to the cache and evicts the least recently used hosts beyond the size limit
+func (r *Resolver) store(name string, addrs []netip.Addr, expiresAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if element, ok := r.cache[name]; ok {
+		entry := element.Value.(*resolverEntry)
+		entry.addrs, entry.expiresAt = addrs, expiresAt
+		r.lru.MoveToFront(element)
+		return
+	}
+
+	r.cache[name] = r.lru.PushFront(&resolverEntry{name: name, addrs: addrs, expiresAt: expiresAt})
+	for r.lru.Len() > r.options.cacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*resolverEntry).name)
+	}
+}
+
+// partition splits the addresses into the primary addresses of the preferred family and the fallback addresses of
+// the other family. Addresses excluded by the IP preference are dropped.
+func (r *Resolver) partition(addrs []netip.Addr) (primaries, fallbacks []netip.Addr) {
+	var preferIPv4 bool
+	switch r.options.preference {
+	case AnyIP:
+		if len(addrs) == 0 {
+			return nil, nil
+		}
+		preferIPv4 = addrs[0].Is4()
+	case PreferIPv4, IPv4Only:
+		preferIPv4 = true
+	}
+
+	for _, addr := range addrs {
+		if addr.Is4() == preferIPv4 {
+			primaries = append(primaries, addr)
+		} else if r.options.preference != IPv4Only && r.options.preference != IPv6Only {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+	return primaries, fallbacks
+}
+
+// resolvingDialer resolves host names using the resolver and connects to the resolved addresses using the dialer
+type resolvingDialer struct {
+	Dialer
+	resolver *Resolver
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	if _, parseErr := netip.ParseAddr(host); parseErr == nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+
+	info, _ := ctx.Value(dialInfoKey{}).(*dialInfo)
+	var ruleHosts map[string][]netip.Addr
+	if info != nil {
+		ruleHosts = info.hosts
+	}
+
+	addrs, source, lookupErr := d.resolver.lookup(ctx, host, ruleHosts)
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	primaries, fallbacks := d.resolver.partition(addrs)
+	if len(primaries) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+
+	conn, dialErr := d.dialParallel(ctx, network, port, primaries, fallbacks)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	if info != nil && info.logger != nil {
+		info.logger.Info().
+			Str("host", host).
+			Str("ip", conn.RemoteAddr().String()).
+			Str("source", source).
+			Msg("resolve")
+	}
+	return conn, nil
+}
+
+// dialParallel connects to the primary addresses and starts connecting to the fallback addresses once the fallback
+// delay elapses, the first established connection is returned
+func (d *resolvingDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []netip.Addr) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, port, primaries)
+	}
+	if d.resolver.options.fallbackDelay < 0 {
+		return d.dialSerial(ctx, network, port, append(primaries, fallbacks...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	dial := func(addrs []netip.Addr, primary bool) {
+		conn, err := d.dialSerial(ctx, network, port, addrs)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	go dial(primaries, true)
+	fallbackTimer := time.NewTimer(d.resolver.options.fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	fallbackStarted := false
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				go dial(fallbacks, false)
+			}
+		case result := <-results:
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if result.primary {
+				primaryErr = result.err
+			} else {
+				fallbackErr = result.err
+			}
+
+			if !fallbackStarted {
+				// the primary addresses failed before the delay elapsed
+				fallbackStarted = true
+				go dial(fallbacks, false)
+			} else if primaryErr != nil && fallbackErr != nil {
+				return nil, primaryErr
+			}
+		}
+	}
+}
+
+// dialSerial connects to the addresses one after another until a connection is established
+func (d *resolvingDialer) dialSerial(ctx context.Context, network, port string, addrs []netip.Addr) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, dialErr := d.Dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = dialErr
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("proxy: no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	resolverIPv4 = netip.MustParseAddr("192.0.2.1")
+	resolverIPv6 = netip.MustParseAddr("2001:db8::1")
+)
+
+type recordingDialer struct {
+	mu     sync.Mutex
+	dialed []string
+	dial   func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	return d.dial(ctx, addr)
+}
+
+func (d *recordingDialer) Dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+func newTestResolvingDialer(t *testing.T, dial func(ctx context.Context, addr string) (net.Conn, error), opts ...ResolverOption) (*resolvingDialer, *recordingDialer) {
+	opts = append([]ResolverOption{WithStaticHost("exchange.test", resolverIPv6, resolverIPv4)}, opts...)
+	resolver, err := NewResolver(opts...)
+	require.NoError(t, err)
+
+	dialer := &recordingDialer{dial: dial}
+	return &resolvingDialer{Dialer: dialer, resolver: resolver}, dialer
+}
+
+func TestParseIPPreference(t *testing.T) {
+	for name, expected := range map[string]IPPreference{
+		"":            AnyIP,
+		"any":         AnyIP,
+		"prefer-ipv4": PreferIPv4,
+		"PREFER-IPV6": PreferIPv6,
+		"ipv4-only":   IPv4Only,
+		"ipv6only":    IPv6Only,
+	} {
+		preference, err := ParseIPPreference(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, preference, name)
+	}
+
+	_, err := ParseIPPreference("ipv5")
+	assert.Error(t, err)
+}
+
+func TestResolverPartition(t *testing.T) {
+	addrs := []netip.Addr{resolverIPv6, resolverIPv4}
+	for preference, expected := range map[IPPreference][2][]netip.Addr{
+		AnyIP:      {{resolverIPv6}, {resolverIPv4}},
+		PreferIPv4: {{resolverIPv4}, {resolverIPv6}},
+		PreferIPv6: {{resolverIPv6}, {resolverIPv4}},
+		IPv4Only:   {{resolverIPv4}, nil},
+		IPv6Only:   {{resolverIPv6}, nil},
+	} {
+		resolver, err := NewResolver(WithIPPreference(preference))
+		require.NoError(t, err)
+
+		primaries, fallbacks := resolver.partition(addrs)
+		assert.Equal(t, expected[0], primaries, preference)
+		assert.Equal(t, expected[1], fallbacks, preference)
+	}
+}
+
+func TestResolverPrefersStaticHostsOfRule(t *testing.T) {
+	// GIVEN
+	resolver, err := NewResolver(WithStaticHost("Exchange.Test.", resolverIPv4))
+	require.NoError(t, err)
+	ruleAddr := netip.MustParseAddr("127.0.0.1")
+
+	// WHEN
+	staticAddrs, staticSource, staticErr := resolver.lookup(context.Background(), "exchange.test", nil)
+	ruleAddrs, ruleSource, ruleErr := resolver.lookup(context.Background(), "EXCHANGE.test",
+		map[string][]netip.Addr{"exchange.test": {ruleAddr}})
+
+	// THEN
+	require.NoError(t, staticErr)
+	assert.Equal(t, []netip.Addr{resolverIPv4}, staticAddrs)
+	assert.Equal(t, "static", staticSource)
+	require.NoError(t, ruleErr)
+	assert.Equal(t, []netip.Addr{ruleAddr}, ruleAddrs)
+	assert.Equal(t, "rule", ruleSource)
+}
+
+func TestResolverCachesLookups(t *testing.T) {
+	// GIVEN
+	resolver, err := NewResolver(WithCacheTTL(time.Minute))
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	resolver.now = func() time.Time { return now }
+	cachedAddrs := []netip.Addr{resolverIPv4}
+	resolver.store("exchange.test", cachedAddrs, now.Add(time.Second))
+
+	// WHEN
+	addrs, source, lookupErr := resolver.lookup(context.Background(), "exchange.test", nil)
+
+	// THEN
+	require.NoError(t, lookupErr)
+	assert.Equal(t, cachedAddrs, addrs)
+	assert.Equal(t, "cache", source)
+
+	// the expired entry is not used
+	now = now.Add(2 * time.Second)
+	_, source, _ = resolver.lookup(context.Background(), "exchange.test", nil)
+	assert.NotEqual(t, "cache", source)
+}
+
+func TestResolverEvictsLeastRecentlyUsedHost(t *testing.T) {
+	// GIVEN
+	resolver, err := NewResolver(WithCacheTTL(time.Minute), WithCacheSize(2))
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(time.Minute)
+	resolver.store("first.test", []netip.Addr{resolverIPv4}, expiresAt)
+	resolver.store("second.test", []netip.Addr{resolverIPv4}, expiresAt)
+	_, _ = resolver.cached("first.test")
+
+	// WHEN
+	resolver.store("third.test", []netip.Addr{resolverIPv4}, expiresAt)
+
+	// THEN
+	_, firstOk := resolver.cached("first.test")
+	_, secondOk := resolver.cached("second.test")
+	_, thirdOk := resolver.cached("third.test")
+	assert.True(t, firstOk)
+	assert.False(t, secondOk)
+	assert.True(t, thirdOk)
+	assert.Equal(t, 2, resolver.lru.Len())
+}
+
+func TestResolvingDialerFallsBackAfterDelay(t *testing.T) {
+	// GIVEN
+	dialer, recorder := newTestResolvingDialer(t, func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr == "[2001:db8::1]:443" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}, WithFallbackDelay(10*time.Millisecond))
+
+	// WHEN
+	conn, err := dialer.DialContext(context.Background(), "tcp", "exchange.test:443")
+
+	// THEN
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, []string{"[2001:db8::1]:443", "192.0.2.1:443"}, recorder.Dialed())
+}
+
+func TestResolvingDialerFallsBackOnError(t *testing.T) {
+	// GIVEN
+	dialer, recorder := newTestResolvingDialer(t, func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}, WithFallbackDelay(time.Hour))
+
+	// WHEN
+	_, err := dialer.DialContext(context.Background(), "tcp", "exchange.test:443")
+
+	// THEN
+	assert.EqualError(t, err, "unreachable")
+	assert.Equal(t, []string{"[2001:db8::1]:443", "192.0.2.1:443"}, recorder.Dialed())
+}
+
+func TestResolvingDialerHonoursIPPreference(t *testing.T) {
+	// GIVEN
+	dialer, recorder := newTestResolvingDialer(t, func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}, WithIPPreference(IPv4Only))
+
+	// WHEN
+	_, err := dialer.DialContext(context.Background(), "tcp", "exchange.test:443")
+
+	// THEN
+	assert.Error(t, err)
+	assert.Equal(t, []string{"192.0.2.1:443"}, recorder.Dialed())
+}
+
+func TestResolvingDialerPassesIPAddresses(t *testing.T) {
+	// GIVEN
+	dialer, recorder := newTestResolvingDialer(t, func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+
+	// WHEN
+	_, _ = dialer.DialContext(context.Background(), "tcp", "198.51.100.1:443")
+
+	// THEN
+	assert.Equal(t, []string{"198.51.100.1:443"}, recorder.Dialed())
+}
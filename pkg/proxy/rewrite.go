@@ -0,0 +1,430 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// RewriteConfig is the YAML document of rewrite rules applied by the handler returned by NewRewriteHandler.
+type RewriteConfig struct {
+	Rules []RewriteRule `yaml:"rules"`
+}
+
+// RewriteRule changes requests matched by Match and their responses. Rules are applied in order, so a later rule sees
+// the request modified by earlier rules, while all rules are matched against the original request.
+type RewriteRule struct {
+	Match RewriteMatch `yaml:"match"`
+	// Path replaces the path of the request matching the regular expression, the replacement may refer to groups,
+	// e.g., $1
+	Path *PathRewrite `yaml:"path"`
+	// Upstream is the host and port dialed instead of the host of the request. It applies to the whole client
+	// connection, so it is used if the rule matches the CONNECT request or the first request of the connection.
+	Upstream string         `yaml:"upstream"`
+	Request  MessageRewrite `yaml:"request"`
+	Response MessageRewrite `yaml:"response"`
+}
+
+// RewriteMatch selects requests by the host name, the method and the path. Empty fields match any request.
+type RewriteMatch struct {
+	// Host is the glob pattern of the host name without the port, e.g., *.example.com
+	Host string `yaml:"host"`
+	// Methods are HTTP methods of the request
+	Methods []string `yaml:"methods"`
+	// Path is the regular expression matched against the path of the request
+	Path string `yaml:"path"`
+}
+
+type PathRewrite struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// MessageRewrite changes headers and the body of the request or the response. Header values are templates, which
+// refer to fields of the original request, i.e., .Method, .Host, .Path, .Query, .Header and .ClientIP, and to
+// environment variables using the env function, e.g., {{ env "TOKEN" }}. Headers missing from the request render as
+// empty strings. Headers are removed first, then set and added. The body is decoded, text replacements are applied before JSON fields are set, and the body is compressed
+// again.
+type MessageRewrite struct {
+	SetHeaders    map[string]string `yaml:"setHeaders"`
+	AddHeaders    map[string]string `yaml:"addHeaders"`
+	RemoveHeaders []string          `yaml:"removeHeaders"`
+	ReplaceText   []TextReplacement `yaml:"replaceText"`
+	// SetJSON sets fields of the JSON body to values, fields are dot-separated paths, e.g., user.roles.0, the body is
+	// left unchanged unless it is a JSON document
+	SetJSON map[string]any `yaml:"setJSON"`
+}
+
+type TextReplacement struct {
+	Old string `yaml:"old"`
+	New string `yaml:"new"`
+}
+
+// LoadRewriteConfig reads rewrite rules from the YAML file, unknown fields are reported as errors.
+func LoadRewriteConfig(fileName string) (*RewriteConfig, error) {
+	data, readErr := os.ReadFile(fileName)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return ParseRewriteConfig(data)
+}
+
+func ParseRewriteConfig(data []byte) (*RewriteConfig, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var config RewriteConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse rewrite rules: %w", err)
+	}
+	return &config, nil
+}
+
+// NewRewriteHandler returns the handler applying rewrite rules. Bodies are buffered using limits of the rule the
+// handler belongs to, and requests or responses whose body can't be read are answered with an error.
+func NewRewriteHandler(config *RewriteConfig) (Handler, error) {
+	h := &rewriteHandler{}
+	for index, rule := range config.Rules {
+		compiled, err := compileRewriteRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rewrite rule %d: %w", index+1, err)
+		}
+		h.rules = append(h.rules, compiled)
+	}
+	return h.Handle, nil
+}
+
+type rewriteHandler struct {
+	rules []*rewriteRule
+}
+
+type rewriteRule struct {
+	host            string
+	methods         []string
+	path            *regexp.Regexp
+	pathPattern     *regexp.Regexp
+	pathReplacement string
+	upstream        string
+	request         *messageRewrite
+	response        *messageRewrite
+}
+
+type messageRewrite struct {
+	set         []headerTemplate
+	add         []headerTemplate
+	remove      []string
+	replaceText []TextReplacement
+	setJSON     []jsonField
+}
+
+type headerTemplate struct {
+	name  string
+	value *template.Template
+}
+
+type jsonField struct {
+	path  []string
+	value any
+}
+
+// rewriteTemplateData holds fields of the request referred to by header templates
+type rewriteTemplateData struct {
+	Method   string
+	Host     string
+	Path     string
+	Query    string
+	Header   rewriteHeader
+	ClientIP string
+}
+
+// rewriteHeader maps canonical names of request headers to their first values, so templates render missing headers
+// as empty strings whether they refer to them by the name, e.g., {{ .Header.Authorization }}, or call Get
+type rewriteHeader map[string]string
+
+func (h rewriteHeader) Get(name string) string {
+	return h[http.CanonicalHeaderKey(name)]
+}
+
+var rewriteFuncs = template.FuncMap{"env": os.Getenv}
+
+func compileRewriteRule(rule RewriteRule) (*rewriteRule, error) {
+	compiled := &rewriteRule{host: strings.ToLower(rule.Match.Host), upstream: rule.Upstream}
+	if _, err := path.Match(compiled.host, ""); err != nil {
+		return nil, fmt.Errorf("invalid host pattern %q", rule.Match.Host)
+	}
+	for _, method := range rule.Match.Methods {
+		compiled.methods = append(compiled.methods, strings.ToUpper(method))
+	}
+	if rule.Match.Path != "" {
+		var err error
+		if compiled.path, err = regexp.Compile(rule.Match.Path); err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %w", err)
+		}
+	}
+	if rule.Path != nil {
+		var err error
+		if compiled.pathPattern, err = regexp.Compile(rule.Path.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid path rewrite: %w", err)
+		}
+		compiled.pathReplacement = rule.Path.Replacement
+	}
+	if rule.Upstream != "" {
+		if _, _, err := net.SplitHostPort(rule.Upstream); err != nil {
+			return nil, fmt.Errorf("invalid upstream: %w", err)
+		}
+	}
+
+	var err error
+	if compiled.request, err = compileMessageRewrite(rule.Request); err != nil {
+		return nil, fmt.Errorf("invalid request rewrite: %w", err)
+	}
+	if compiled.response, err = compileMessageRewrite(rule.Response); err != nil {
+		return nil, fmt.Errorf("invalid response rewrite: %w", err)
+	}
+	return compiled, nil
+}
+
+func compileMessageRewrite(rewrite MessageRewrite) (*messageRewrite, error) {
+	compiled := &messageRewrite{remove: rewrite.RemoveHeaders, replaceText: rewrite.ReplaceText}
+	var err error
+	if compiled.set, err = compileHeaderTemplates(rewrite.SetHeaders); err != nil {
+		return nil, err
+	}
+	if compiled.add, err = compileHeaderTemplates(rewrite.AddHeaders); err != nil {
+		return nil, err
+	}
+	for _, replacement := range rewrite.ReplaceText {
+		if replacement.Old == "" {
+			return nil, errors.New("text to replace is empty")
+		}
+	}
+	for _, fieldPath := range sortedKeys(rewrite.SetJSON) {
+		compiled.setJSON = append(compiled.setJSON, jsonField{path: strings.Split(fieldPath, "."), value: rewrite.SetJSON[fieldPath]})
+	}
+	return compiled, nil
+}
+
+func compileHeaderTemplates(headers map[string]string) ([]headerTemplate, error) {
+	var templates []headerTemplate
+	for _, name := range sortedKeys(headers) {
+		value, err := template.New(name).Funcs(rewriteFuncs).Option("missingkey=zero").Parse(headers[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of the %s header: %w", name, err)
+		}
+		templates = append(templates, headerTemplate{name: name, value: value})
+	}
+	return templates, nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (r *rewriteRule) matches(req *http.Request) bool {
+	if r.host != "" {
+		host := req.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if matched, _ := path.Match(r.host, strings.ToLower(host)); !matched {
+			return false
+		}
+	}
+	if len(r.methods) > 0 && !slices.Contains(r.methods, req.Method) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+func (h *rewriteHandler) Handle(c *Context) {
+	var matched []*rewriteRule
+	for _, rule := range h.rules {
+		if rule.matches(c.Request) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		c.Next()
+		return
+	}
+
+	for _, rule := range matched {
+		if rule.upstream != "" {
+			c.SetUpstreamAddr(rule.upstream)
+		}
+	}
+	if c.Request.Method == http.MethodConnect {
+		// the tunnel has neither headers nor the body to rewrite
+		c.Next()
+		return
+	}
+
+	data := newRewriteTemplateData(c)
+	for _, rule := range matched {
+		if rule.pathPattern != nil {
+			c.Request.URL.Path = rule.pathPattern.ReplaceAllString(c.Request.URL.Path, rule.pathReplacement)
+			c.Request.URL.RawPath = ""
+		}
+		if err := rule.request.apply(c, c.Request.Header, data, c.RequestBody); err != nil {
+			c.s.logger.Info().Err(err).Msg("rewrite-request")
+			c.Response = newHTTP11Response(rewriteErrorStatus(err, http.StatusBadRequest), c.Request)
+			return
+		}
+	}
+
+	c.Next()
+	if c.Response == nil {
+		return
+	}
+
+	for _, rule := range matched {
+		if err := rule.response.apply(c, c.Response.Header, data, c.ResponseBody); err != nil {
+			c.s.logger.Info().Err(err).Msg("rewrite-response")
+			c.Response = newHTTP11Response(rewriteErrorStatus(err, http.StatusBadGateway), c.Request)
+			return
+		}
+	}
+}
+
+func (m *messageRewrite) apply(c *Context, header http.Header, data *rewriteTemplateData, body func() (*BufferedBody, error)) error {
+	for _, name := range m.remove {
+		header.Del(name)
+	}
+	for _, h := range m.set {
+		value, err := h.execute(data)
+		if err != nil {
+			return err
+		}
+		header.Set(h.name, value)
+	}
+	for _, h := range m.add {
+		value, err := h.execute(data)
+		if err != nil {
+			return err
+		}
+		header.Add(h.name, value)
+	}
+
+	if len(m.replaceText) == 0 && len(m.setJSON) == 0 {
+		return nil
+	}
+	buffered, err := body()
+	if err != nil {
+		return err
+	}
+	content, err := buffered.Bytes()
+	if err != nil {
+		return err
+	}
+	for _, replacement := range m.replaceText {
+		content = bytes.ReplaceAll(content, []byte(replacement.Old), []byte(replacement.New))
+	}
+	if len(m.setJSON) > 0 {
+		content = setJSONFields(content, m.setJSON)
+	}
+	return buffered.Replace(content)
+}
+
+func (h headerTemplate) execute(data *rewriteTemplateData) (string, error) {
+	var value strings.Builder
+	if err := h.value.Execute(&value, data); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+func newRewriteTemplateData(c *Context) *rewriteTemplateData {
+	data := &rewriteTemplateData{
+		Method: c.Request.Method,
+		Host:   c.Request.Host,
+		Path:   c.Request.URL.Path,
+		Query:  c.Request.URL.RawQuery,
+		Header: make(rewriteHeader, len(c.Request.Header)),
+	}
+	for name, values := range c.Request.Header {
+		if len(values) > 0 {
+			data.Header[name] = values[0]
+		}
+	}
+	if ip := c.ClientIP(); ip != nil {
+		data.ClientIP = ip.String()
+	}
+	return data
+}
+
+func rewriteErrorStatus(err error, defaultStatus int) int {
+	if errors.Is(err, ErrBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return defaultStatus
+}
+
+// setJSONFields returns the document with fields set to values, the content is returned unchanged if it is not JSON
+func setJSONFields(content []byte, fields []jsonField) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return content
+	}
+
+	for _, field := range fields {
+		document = setJSONField(document, field.path, field.value)
+	}
+	// HTML characters are written as they are, so text that isn't changed keeps its encoding
+	var updated bytes.Buffer
+	encoder := json.NewEncoder(&updated)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return content
+	}
+	return bytes.TrimSuffix(updated.Bytes(), []byte("\n"))
+}
+
+// setJSONField sets the value at the path, missing objects are created, while missing array elements are skipped
+func setJSONField(node any, fieldPath []string, value any) any {
+	if len(fieldPath) == 0 {
+		return value
+	}
+
+	switch typed := node.(type) {
+	case map[string]any:
+		typed[fieldPath[0]] = setJSONField(typed[fieldPath[0]], fieldPath[1:], value)
+		return typed
+	case []any:
+		index, err := strconv.Atoi(fieldPath[0])
+		if err != nil || index < 0 || index >= len(typed) {
+			return typed
+		}
+		typed[index] = setJSONField(typed[index], fieldPath[1:], value)
+		return typed
+	case nil:
+		return map[string]any{fieldPath[0]: setJSONField(nil, fieldPath[1:], value)}
+	default:
+		return node
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newRewriteTestHandler(t *testing.T, config string) Handler {
+	rewriteConfig, parseErr := ParseRewriteConfig([]byte(config))
+	require.NoError(t, parseErr)
+	h, err := NewRewriteHandler(rewriteConfig)
+	require.NoError(t, err)
+	return h
+}
+
+// newRewriteTestContext returns the context whose origin server echoes the request body and headers
+func newRewriteTestContext(r *http.Request, received **http.Request) *Context {
+	c := NewTestOnlyContext(func(c *Context) {
+		*received = c.Request
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Response = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Server": {"origin"}},
+			Body:       io.NopCloser(strings.NewReader(string(body))),
+		}
+	})
+	c.Request = r
+	return c
+}
+
+func TestParseRewriteConfigRejectsUnknownFields(t *testing.T) {
+	_, err := ParseRewriteConfig([]byte("rules:\n  - match:\n      hots: example.com\n"))
+
+	assert.ErrorContains(t, err, "field hots not found")
+}
+
+func TestNewRewriteHandlerRejectsInvalidRules(t *testing.T) {
+	for name, config := range map[string]string{
+		"path":     "rules:\n  - match:\n      path: '('\n",
+		"host":     "rules:\n  - match:\n      host: '['\n",
+		"upstream": "rules:\n  - upstream: example.com\n",
+		"template": "rules:\n  - request:\n      setHeaders:\n        X-User: '{{ .User'\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			rewriteConfig, parseErr := ParseRewriteConfig([]byte(config))
+			require.NoError(t, parseErr)
+
+			_, err := NewRewriteHandler(rewriteConfig)
+
+			assert.ErrorContains(t, err, "failed to parse rewrite rule 1")
+		})
+	}
+}
+
+func TestRewriteHeadersAndPath(t *testing.T) {
+	// GIVEN
+	t.Setenv("REWRITE_TOKEN", "secret")
+	h := newRewriteTestHandler(t, `
+rules:
+  - match:
+      host: "*.example.com"
+      methods: [get]
+      path: ^/v1/
+    path:
+      pattern: ^/v1/(.*)
+      replacement: /v2/$1
+    request:
+      removeHeaders: [Cookie]
+      setHeaders:
+        Authorization: 'Bearer {{ env "REWRITE_TOKEN" }}'
+        X-Original-Path: '{{ .Path }}'
+    response:
+      removeHeaders: [Server]
+      addHeaders:
+        X-Method: '{{ .Method }}'
+  - match:
+      host: other.com
+    request:
+      setHeaders:
+        X-Other: "true"
+`)
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com:8080/v1/users", nil)
+	r.Header.Set("Cookie", "session=1")
+	var received *http.Request
+	c := newRewriteTestContext(r, &received)
+
+	// WHEN
+	h(c)
+
+	// THEN
+	assert.Equal(t, "/v2/users", received.URL.Path)
+	assert.Empty(t, received.Header.Get("Cookie"))
+	assert.Equal(t, "Bearer secret", received.Header.Get("Authorization"))
+	assert.Equal(t, "/v1/users", received.Header.Get("X-Original-Path"))
+	assert.Empty(t, received.Header.Get("X-Other"))
+	assert.Empty(t, c.Response.Header.Get("Server"))
+	assert.Equal(t, "GET", c.Response.Header.Get("X-Method"))
+}
+
+func TestRewriteSkipsUnmatchedRequest(t *testing.T) {
+	h := newRewriteTestHandler(t, "rules:\n  - match:\n      methods: [POST]\n    request:\n      setHeaders:\n        X-Rewritten: 'true'\n")
+	var received *http.Request
+	c := newRewriteTestContext(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), &received)
+
+	h(c)
+
+	assert.Empty(t, received.Header.Get("X-Rewritten"))
+}
+
+func TestRewriteRendersMissingHeadersAsEmpty(t *testing.T) {
+	// GIVEN
+	h := newRewriteTestHandler(t, `
+rules:
+  - request:
+      setHeaders:
+        X-Token: '{{ .Header.Authorization }}'
+        X-Agent: '{{ .Header.Get "user-agent" }}'
+        X-Trace: '{{ index .Header "X-Trace-Id" }}'
+`)
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("User-Agent", "client")
+	var received *http.Request
+	c := newRewriteTestContext(r, &received)
+
+	// WHEN
+	h(c)
+
+	// THEN
+	require.NotNil(t, received)
+	assert.Equal(t, http.StatusOK, c.Response.StatusCode)
+	assert.Equal(t, []string{""}, received.Header.Values("X-Token"))
+	assert.Equal(t, "client", received.Header.Get("X-Agent"))
+	assert.Equal(t, []string{""}, received.Header.Values("X-Trace"))
+}
+
+func TestRewriteBody(t *testing.T) {
+	// GIVEN
+	h := newRewriteTestHandler(t, `
+rules:
+  - request:
+      replaceText:
+        - old: alice
+          new: bob
+      setJSON:
+        user.roles.0: admin
+        user.active: true
+        limits:
+          requests: 10
+    response:
+      replaceText:
+        - old: bob
+          new: carol
+`)
+	body := `{"user":{"name":"alice","roles":["guest"]},"id":12345678901234567890}`
+	var received *http.Request
+	c := newRewriteTestContext(httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body)), &received)
+
+	// WHEN
+	h(c)
+
+	// THEN
+	responseBody, err := io.ReadAll(c.Response.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"user":{"name":"carol","roles":["admin"],"active":true},"limits":{"requests":10},"id":12345678901234567890}`, string(responseBody))
+}
+
+func TestSetJSONFieldsKeepsHTMLCharacters(t *testing.T) {
+	content := []byte(`{"query":"a < b && b > c"}`)
+
+	updated := setJSONFields(content, []jsonField{{path: []string{"link"}, value: "<a href=\"/?x=1&y=2\">"}})
+
+	assert.Equal(t, `{"link":"<a href=\"/?x=1&y=2\">","query":"a < b && b > c"}`, string(updated))
+}
+
+func TestSetJSONFieldsLeavesOtherDocumentsUnchanged(t *testing.T) {
+	content := []byte("not json")
+
+	updated := setJSONFields(content, []jsonField{{path: []string{"name"}, value: "bob"}})
+
+	assert.Equal(t, content, updated)
+}
@@ -5,11 +5,56 @@
 
 package proxy
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"net/netip"
+)
 
 type Rule struct {
 	Action       Action
 	ClientConfig func(host string) (*tls.Config, error)
 	ServerConfig func(host string) (*tls.Config, error)
 	Handlers     []Handler
+	Forwarding   ForwardingPolicy
+
+	// SNI controls inspection of the TLS ClientHello of tunneled connections
+	SNI SNIPolicy
+	// AllowedServerNames are accepted by EnforceSNI in addition to the CONNECT host, "*." matches any subdomain
+	AllowedServerNames []string
+
+	// Upstream is the parent proxy used to reach origin servers instead of the default upstream proxy of the engine
+	Upstream *UpstreamProxy
+
+	// Hosts resolves lower case host names to the addresses without querying the DNS server, like /etc/hosts. Hosts
+	// reached through an upstream proxy are resolved by the proxy unless it uses the socks5 scheme.
+	Hosts map[string][]netip.Addr
+
+	// DisableHTTP2 stops advertising h2 to clients of intercepted connections, so they fall back to HTTP/1.1
+	DisableHTTP2 bool
+	// DisableServerHTTP2 stops offering h2 to origin servers of intercepted connections, so requests are sent using
+	// HTTP/1.1
+	DisableServerHTTP2 bool
+
+	// WebsocketHandlers receive messages of websockets instead of copying bytes between the client and the origin
+	// server. Handlers see the plaintext only if the connection is intercepted.
+	WebsocketHandlers []WebsocketHandler
+
+	// MaxBodySize limits the decoded size of bodies read by RequestBody and ResponseBody of Context, 10 MiB if not set
+	MaxBodySize int64
+	// BodyMemorySize is the part of the buffered body kept in memory, the rest is written to a temporary file, 1 MiB if
+	// not set
+	BodyMemorySize int64
+
+	// OnConnect hooks run for CONNECT requests before the action of the rule is applied. A hook setting the response
+	// answers the request without running handlers.
+	OnConnect []Hook
+	// OnRequest hooks run for other requests before handlers. A hook setting the response answers the request without
+	// running handlers.
+	OnRequest []Hook
+	// OnResponse hooks run once the response is known, before it is sent to the client
+	OnResponse []Hook
+	// OnError hooks run if the request fails to reach the origin server, before OnResponse hooks
+	OnError []ErrorHook
+	// OnTunnelClose hooks run once the tunnel is closed, including tunnels of websockets
+	OnTunnelClose []TunnelCloseHook
 }
@@ -10,10 +10,14 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"github.com/pmateusz/glove/internal/urllib"
 	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
 	"net"
 	"net/http"
 	"syscall"
+	"time"
 )
 
 type session struct {
@@ -22,6 +26,15 @@ type session struct {
 	engine *Engine
 	rule   *Rule
 
+	// ctx is cancelled when the session is closed or the engine is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// requestCtx is cancelled once the request is handled or the client disconnects, see Context.Ctx
+	requestCtx    context.Context
+	cancelRequest context.CancelFunc
+	// stopWatching stops watching the client connection for the disconnect, it is set while the client is watched
+	stopWatching func()
+
 	scheme          string
 	proxyRemoteAddr string
 
@@ -30,21 +43,57 @@ type session struct {
 
 	serverRemoteAddr string
 	serverHost       string
-	clientTLSConfig  *tls.Config
-	serverConn       net.Conn
-	serverReader     *bufio.Reader
+	// upstreamAddr is dialed instead of the host of the request if set
+	upstreamAddr    string
+	clientTLSConfig *tls.Config
+	serverConn      net.Conn
+	serverReader    *bufio.Reader
+	forwardProxy    *UpstreamProxy
+	// serverPlaintext is set if the origin server doesn't support TLS although the client sent the CONNECT request
+	serverPlaintext bool
+	// serverClose is set if the origin server closes the connection once the response is read
+	serverClose bool
+	// serverConns are shared by streams of the HTTP/2 client connection
+	serverConns *serverConnPool
+	// serverHTTP2 is the HTTP/2 connection to the origin server shared with other sessions, it is used instead of
+	// serverConn if set
+	serverHTTP2 *http2Conn
+	// serverEgressKey is the key the egress pool selected the local address of serverConn or serverHTTP2 by
+	serverEgressKey string
+
+	// overrideAction, overrideClientConfig and overrideServerConfig are set by handlers to replace the rule for the
+	// session
+	overrideAction       *Action
+	overrideClientConfig *tls.Config
+	overrideServerConfig *tls.Config
+
+	// attributes are attached to the client connection by handlers
+	attributes *attributeStore
 
 	close             bool
 	callDepth         int
 	postRequestAction func() error
+	// err is the reason the request didn't reach the origin server, it is passed to error hooks
+	err error
+	// tunnelStats is set once the tunnel is closed, it is passed to tunnel close hooks
+	tunnelStats *TunnelStats
+
+	// writeResponse sends the response to the client, it is replaced by front-ends other than HTTP
+	writeResponse func(resp *http.Response) error
 }
 
 // TODO: generate unique session id
 func newSession(conn net.Conn, r *http.Request, e *Engine) (*session, error) {
-	logger := e.logger.With().
+	loggerContext := e.logger.With().
 		Str("clientAddr", conn.RemoteAddr().String()).
-		Str("serverAddr", r.Host).
-		Logger()
+		Str("serverAddr", r.Host)
+	if proxyAddr := proxyProtocolAddr(conn); proxyAddr != nil {
+		loggerContext = loggerContext.Str("proxyAddr", proxyAddr.String())
+	}
+	if clientIP := e.clientIPResolver.ClientIP(r); clientIP != nil && !clientIP.Equal(urllib.RemoteIp(r)) {
+		loggerContext = loggerContext.IPAddr("clientIP", clientIP)
+	}
+	logger := loggerContext.Logger()
 
 	serverHost, _, addrErr := net.SplitHostPort(r.Host)
 	if addrErr != nil {
@@ -61,8 +110,11 @@ func newSession(conn net.Conn, r *http.Request, e *Engine) (*session, error) {
 		rule = e.defaultRule
 	}
 
+	ctx, cancel := context.WithCancel(e.ctx)
 	return &session{
 		logger:           logger,
+		ctx:              ctx,
+		cancel:           cancel,
 		clientConn:       conn,
 		clientReader:     bufio.NewReader(conn),
 		close:            false,
@@ -73,10 +125,22 @@ func newSession(conn net.Conn, r *http.Request, e *Engine) (*session, error) {
 		engine:           e,
 		tools:            newNetTools(logger),
 		rule:             rule,
+		attributes:       &attributeStore{},
 	}, nil
 }
 
+// action returns the action set by handlers for the session or the action of the rule
+func (s *session) action() Action {
+	if s.overrideAction != nil {
+		return *s.overrideAction
+	}
+	return s.rule.Action
+}
+
 func (s *session) clientConfigOrDefault() (*tls.Config, error) {
+	if s.overrideClientConfig != nil {
+		return s.overrideClientConfig, nil
+	}
 	if s.rule.ClientConfig != nil {
 		return s.rule.ClientConfig(s.serverHost)
 	}
@@ -84,10 +148,166 @@ func (s *session) clientConfigOrDefault() (*tls.Config, error) {
 }
 
 func (s *session) serverConfigOrDefault() (*tls.Config, error) {
-	if s.rule.ServerConfig != nil {
-		return s.rule.ServerConfig(s.serverHost)
+	var config *tls.Config
+	var err error
+	if s.overrideServerConfig != nil {
+		config = s.overrideServerConfig
+	} else if s.rule.ServerConfig != nil {
+		config, err = s.rule.ServerConfig(s.serverHost)
+	} else {
+		config, err = s.engine.serverConfig(s.serverHost)
+	}
+
+	if err == nil && config != nil && config.ServerName == "" && s.upstreamAddr != "" {
+		// the server name can't be inferred from the dialed address
+		config = config.Clone()
+		config.ServerName = s.serverHost
+	}
+	return config, err
+}
+
+// upstreamProxy returns the parent proxy used to reach the origin server or nil if the origin server should be dialed
+// directly
+func (s *session) upstreamProxy() *UpstreamProxy {
+	upstream := s.rule.Upstream
+	if upstream == nil {
+		upstream = s.engine.upstream
+	}
+
+	if upstream == nil || upstream.excludes(s.serverRemoteAddr) {
+		return nil
+	}
+	return upstream
+}
+
+// writeRequest sends the request to the origin server or the upstream proxy, which expects the request in the
+// absolute form
+func (s *session) writeRequest(r *http.Request) error {
+	if s.forwardProxy == nil {
+		return r.Write(s.serverConn)
+	}
+
+	if authorization := s.forwardProxy.authorization(); authorization != "" {
+		r.Header.Set("Proxy-Authorization", authorization)
+		defer r.Header.Del("Proxy-Authorization")
 	}
-	return s.engine.serverConfig(s.serverHost)
+	return r.WriteProxy(s.serverConn)
+}
+
+// watchClient calls cancel if the client disconnects before the returned stop function is called. The client
+// connection must not be read until then.
+func (s *session) watchClient(cancel context.CancelFunc) func() {
+	if s.clientReader == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// bytes sent by the client are peeked, so they can be read later
+		_, peekErr := s.clientReader.Peek(1)
+		var netErr net.Error
+		if peekErr != nil && !(errors.As(peekErr, &netErr) && netErr.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return func() {
+		_ = s.clientConn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		_ = s.clientConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// beginRequest creates the context of the request. The client is watched for the disconnect right away unless the
+// request has a body, which is read from the client connection later.
+func (s *session) beginRequest(r *http.Request) {
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.requestCtx, s.cancelRequest = context.WithCancel(s.ctx)
+	if r.Body == nil || r.Body == http.NoBody {
+		s.watch()
+	}
+}
+
+// watch starts watching the client for the disconnect unless it is already watched
+func (s *session) watch() {
+	if s.stopWatching == nil {
+		s.stopWatching = s.watchClient(s.cancelRequest)
+	}
+}
+
+// unwatch stops watching the client, so the client connection can be read
+func (s *session) unwatch() {
+	if s.stopWatching != nil {
+		s.stopWatching()
+		s.stopWatching = nil
+	}
+}
+
+// dialContext returns the context of a dial started by the request. The client is watched until the returned stop
+// function is called, unless it was already watched.
+func (s *session) dialContext(r *http.Request) (context.Context, func()) {
+	stopWatching := func() {}
+	if s.stopWatching == nil {
+		s.watch()
+		stopWatching = s.unwatch
+	}
+
+	info := &dialInfo{
+		clientIP: s.engine.clientIPResolver.ClientIP(r),
+		request:  r,
+		hosts:    s.rule.Hosts,
+		logger:   &s.logger,
+	}
+	s.serverEgressKey = s.egressKey(r)
+	return context.WithValue(s.requestCtx, dialInfoKey{}, info), stopWatching
+}
+
+// egressKey returns the key the egress pool selects the local address of the connection by for the request
+func (s *session) egressKey(r *http.Request) string {
+	if s.engine == nil || s.engine.egress == nil {
+		return ""
+	}
+	return s.engine.egress.requestKey(s.engine.clientIPResolver.ClientIP(r), r)
+}
+
+// observeEgress excludes the address of the egress pool that received the response if the address is rate limited,
+// so the connection isn't used for the following requests
+func (s *session) observeEgress(localAddr net.Addr, resp *http.Response) bool {
+	if s.engine == nil || s.engine.egress == nil {
+		return false
+	}
+
+	stats, excluded := s.engine.egress.observe(localAddr, resp)
+	if excluded {
+		s.logger.Info().
+			Str("egressAddr", stats.Addr.String()).
+			Int("status", resp.StatusCode).
+			Time("excludedUntil", stats.ExcludedUntil).
+			Int("active", stats.Active).
+			Uint64("total", stats.Total).
+			Uint64("failed", stats.Failed).
+			Uint64("rejected", stats.Rejected).
+			Msg("egress-excluded")
+	}
+	return excluded
+}
+
+// egressExcluded reports whether the local address of the connection is excluded from the egress pool
+func (s *session) egressExcluded(localAddr net.Addr) bool {
+	return s.engine != nil && s.engine.egress != nil && s.engine.egress.excluded(localAddr)
+}
+
+// dialAddr returns the address of the origin server, which is the host of the request unless the session was
+// directed to another upstream address
+func (s *session) dialAddr(r *http.Request) string {
+	if s.upstreamAddr != "" {
+		return s.upstreamAddr
+	}
+	return r.Host
 }
 
 func (s *session) readRequest() (*http.Request, error) {
@@ -103,31 +323,139 @@ func (s *session) readRequest() (*http.Request, error) {
 }
 
 func (s *session) handle(r *http.Request) {
-	c := &Context{Request: r, s: s}
-	c.Next()
+	start := time.Now()
+	s.beginRequest(r)
+	c := &Context{Request: r, s: s, ctx: s.requestCtx}
+	if r.Method == http.MethodConnect {
+		s.runHooks(c, s.rule.OnConnect)
+	} else {
+		s.runHooks(c, s.rule.OnRequest)
+	}
+	if c.Response == nil {
+		// hooks answering the request skip the handlers
+		c.Next()
+	}
 	if c.Response == nil {
 		s.logger.Error().Msg("no-response")
 		s.close = true
 		c.Response = newHTTP11Response(http.StatusInternalServerError, c.Request)
 	}
+	if s.err != nil {
+		s.runErrorHooks(c)
+	}
+	s.runHooks(c, s.rule.OnResponse)
+	if c.responseBody != nil && c.bufferedResponse == c.Response && hasResponseBody(c.Request, c.Response) {
+		resp := c.Response
+		if err := setBody(c.responseBody, resp.Header, &resp.Body, &resp.ContentLength, &resp.TransferEncoding); err != nil {
+			c.Response = s.onEncodeBodyError(c.Request, err)
+		}
+	}
+	defer c.closeBodies()
 
 	defer s.tools.CloseBody(c.Response)
+	if s.ctx.Err() != nil {
+		// the session was closed while the request was handled
+		s.close = true
+	}
 	c.Response.Close = s.close
-	if err := c.Response.Write(s.clientConn); err != nil {
+	if err := s.write(c.Response); err != nil {
 		s.close = true
 		if !errors.Is(err, syscall.EPIPE) {
 			withConn(s.logger.Info(), s.clientConn).Err(err).Msg("write")
 		}
 	}
+	if c.IsGRPC() {
+		s.logGRPC(c)
+	}
+	if s.engine != nil && s.engine.accessLog {
+		s.logAccess(c, start)
+	}
+	s.unwatch()
 
 	if s.postRequestAction != nil {
 		if err := s.postRequestAction(); err != nil {
 			s.close = true
 		}
 	}
+	if s.tunnelStats != nil {
+		s.runTunnelCloseHooks(c)
+	}
 	s.reset()
 }
 
+// runHooks calls hooks one after another, a panic is recovered the same way as in handlers
+func (s *session) runHooks(c *Context, hooks []Hook) {
+	for _, hook := range hooks {
+		s.runHook(c, func() { hook(c) })
+	}
+}
+
+func (s *session) runErrorHooks(c *Context) {
+	for _, hook := range s.rule.OnError {
+		s.runHook(c, func() { hook(c, s.err) })
+	}
+}
+
+func (s *session) runTunnelCloseHooks(c *Context) {
+	for _, hook := range s.rule.OnTunnelClose {
+		s.runHook(c, func() { hook(c, *s.tunnelStats) })
+	}
+}
+
+func (s *session) runHook(c *Context, hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error().Str("panic", fmt.Sprintf("%v", r)).Msg("recovered")
+			s.close = true
+			c.Response = newHTTP11Response(http.StatusInternalServerError, c.Request)
+		}
+	}()
+	hook()
+}
+
+// logAccess logs the request, the response and loggable attributes of the request and the client connection
+func (s *session) logAccess(c *Context, start time.Time) {
+	event := s.logger.Info().
+		Str("method", c.Request.Method).
+		Str("host", c.Request.Host).
+		Str("path", c.Request.URL.Path).
+		Str("proto", c.Request.Proto).
+		Int("status", c.Response.StatusCode).
+		Dur("duration", time.Since(start))
+
+	// attributes of the request hide attributes of the client connection
+	logged := make(map[attributeKey]bool)
+	event = c.attributes.log(event, logged)
+	event = s.attributes.log(event, logged)
+	event.Msg("access")
+}
+
+// logGRPC logs the method and the status of the gRPC call once the trailers are read
+func (s *session) logGRPC(c *Context) {
+	event := s.logger.Info().Str("method", c.GRPCMethod())
+	if code, message, ok := c.GRPCStatus(); ok {
+		event = event.Stringer("grpcStatus", code).Str("grpcMessage", message)
+	} else {
+		event = event.Int("status", c.Response.StatusCode)
+	}
+	event.Msg("grpc")
+}
+
+func (s *session) write(resp *http.Response) error {
+	if s.writeResponse != nil {
+		return s.writeResponse(resp)
+	}
+
+	if resp.ProtoMajor > 1 {
+		// the response received from the origin server using HTTP/2 is sent to the client using HTTP/1.1
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = HTTP11, 1, 1
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+	}
+	return resp.Write(s.clientConn)
+}
+
 func (s *session) nextHandler() Handler {
 	if s.callDepth < len(s.rule.Handlers) {
 		h := s.rule.Handlers[s.callDepth]
@@ -145,46 +473,136 @@ func (s *session) handler(c *Context) {
 func (s *session) reset() {
 	s.callDepth = 0
 	s.postRequestAction = nil
+	s.err, s.tunnelStats = nil, nil
+	s.unwatch()
+	if s.cancelRequest != nil {
+		s.cancelRequest()
+	}
+
+	if s.serverClose && s.serverConn != nil {
+		// the connection is opened again by the next request
+		s.tools.CloseConn(s.serverConn)
+		s.serverConn, s.serverReader, s.forwardProxy = nil, nil, nil
+	}
+	s.serverClose = false
+}
+
+// closeServerConn closes the connection to the origin server, the HTTP/2 connection shared with other sessions is
+// only released
+func (s *session) closeServerConn() {
+	if s.serverConn != nil {
+		s.tools.CloseConn(s.serverConn)
+		s.serverConn, s.serverReader, s.forwardProxy = nil, nil, nil
+	}
+	s.serverHTTP2 = nil
 }
 
 func (s *session) Close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
 	s.tools.CloseConn(s.clientConn)
 	if s.serverConn != nil {
 		s.tools.CloseConn(s.serverConn)
 	}
+	if s.serverConns != nil {
+		s.serverConns.Close()
+	}
 }
 
 func (s *session) tunnel() error {
-	s.tools.Pipe(s.clientConn, s.serverConn)
+	// both connections are interrupted if the session is closed
+	defer withConnContext(s.ctx, s.clientConn)()
+	defer withConnContext(s.ctx, s.serverConn)()
+
+	start := time.Now()
+	received, sent := s.tools.Pipe(s.clientConn, s.serverConn)
+	s.tunnelStats = &TunnelStats{BytesSent: sent, BytesReceived: received, Duration: time.Since(start)}
 	s.close = true
 	return nil
 }
 
+// inspectedTunnel verifies the ClientHello according to the SNI policy of the rule before the tunnel is established
+func (s *session) inspectedTunnel() error {
+	if s.rule.SNI != IgnoreSNI {
+		if err := s.inspectClientHello(); err != nil {
+			return err
+		}
+	}
+	return s.tunnel()
+}
+
+// inspectClientHello peeks the ClientHello, so it is still sent to the origin server
+func (s *session) inspectClientHello() error {
+	reader := bufio.NewReaderSize(s.clientReader, clientHelloPeekCapacity)
+	s.clientConn = &bufferedConn{Conn: s.clientConn, reader: reader}
+	s.clientReader = reader
+
+	_ = s.clientConn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer func() { _ = s.clientConn.SetReadDeadline(time.Time{}) }()
+
+	enforce := s.rule.SNI == EnforceSNI
+	if !isTLSHandshake(reader) {
+		s.logger.Info().Bool("enforce", enforce).Msg("tunnel-not-tls")
+		if enforce {
+			return errNotTLS
+		}
+		return nil
+	}
+
+	hello, helloErr := peekClientHello(reader)
+	if helloErr != nil {
+		s.logger.Info().Err(helloErr).Bool("enforce", enforce).Msg("client-hello")
+		if enforce {
+			return helloErr
+		}
+		return nil
+	}
+
+	s.logger.Info().
+		Str("serverName", hello.serverName).
+		Strs("alpn", hello.alpnProtocols).
+		Msg("client-hello")
+
+	if enforce {
+		if verifyErr := verifyServerName(hello.serverName, s.serverHost, s.rule.AllowedServerNames); verifyErr != nil {
+			s.logger.Info().Str("serverName", hello.serverName).Msg("sni-mismatch")
+			return verifyErr
+		}
+	}
+	return nil
+}
+
 func (s *session) clientHandshake() error {
-	tlsClientConn := tls.Server(s.clientConn, s.clientTLSConfig)
+	tlsClientConn := tls.Server(s.clientConn, withHTTP2(s.clientTLSConfig, s.rule.DisableHTTP2))
 	if handshakeErr := tlsClientConn.Handshake(); handshakeErr != nil {
 		return handshakeErr
 	}
 
 	s.clientConn = tlsClientConn
 	s.clientReader = bufio.NewReader(s.clientConn)
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		s.serveHTTP2()
+	}
 	return nil
 }
 
 func (s *session) execute(c *Context) *http.Response {
-	if s.rule.Action == BlockAction {
+	if s.action() == BlockAction {
 		return newHTTP11Response(http.StatusForbidden, nil)
 	}
 
 	if c.Request.Method == http.MethodConnect {
-		if s.rule.Action == TunnelAction {
+		if s.action() == TunnelAction {
 			// TCP tunnel
-			serverConn, dialErr := s.engine.dialTCP(c.Request.Host)
+			ctx, stopWatching := s.dialContext(c.Request)
+			serverConn, dialErr := s.engine.dialTCP(ctx, s.upstreamProxy(), s.dialAddr(c.Request))
+			stopWatching()
 			if dialErr != nil {
 				return s.onTCPDialError(c.Request, dialErr)
 			}
 			s.serverConn = serverConn
-			s.postRequestAction = s.tunnel
+			s.postRequestAction = s.inspectedTunnel
 			return newHTTP10ConnectionEstablished(c.Request)
 		}
 
@@ -193,8 +611,7 @@ func (s *session) execute(c *Context) *http.Response {
 			return s.onTLSConfigError(c.Request, serverConfigErr)
 		}
 
-		serverConn, dialErr := s.engine.dialTLS(c.Request.Host, serverConfig)
-		if dialErr != nil {
+		if dialErr := s.dialServerTLS(c.Request, serverConfig); dialErr != nil {
 			var headerErr tls.RecordHeaderError
 			if errors.As(dialErr, &headerErr) {
 				withConn(s.logger.Info(), headerErr.Conn).
@@ -202,7 +619,9 @@ func (s *session) execute(c *Context) *http.Response {
 					Str("msg", headerErr.Msg).
 					Msg("tls-not-supported")
 
-				tcpServerConn, tcpDialErr := s.engine.dialTCP(c.Request.Host)
+				ctx, stopWatching := s.dialContext(c.Request)
+				tcpServerConn, tcpDialErr := s.engine.dialTCP(ctx, s.upstreamProxy(), s.dialAddr(c.Request))
+				stopWatching()
 				if tcpDialErr != nil {
 					return s.onTCPDialError(c.Request, tcpDialErr)
 				}
@@ -214,6 +633,7 @@ func (s *session) execute(c *Context) *http.Response {
 
 				s.serverConn = tcpServerConn
 				s.serverReader = bufio.NewReader(s.serverConn)
+				s.serverPlaintext = true
 				s.clientTLSConfig = clientConfig
 				s.postRequestAction = s.clientHandshake
 				return newHTTP10ConnectionEstablished(c.Request)
@@ -227,8 +647,6 @@ func (s *session) execute(c *Context) *http.Response {
 			return s.onTCPDialError(c.Request, dialErr)
 		}
 
-		s.serverConn = serverConn
-		s.serverReader = bufio.NewReader(s.serverConn)
 		clientConfig, clientConfigErr := s.clientConfigOrDefault()
 		if clientConfigErr != nil {
 			return s.onTLSConfigError(c.Request, clientConfigErr)
@@ -239,46 +657,139 @@ func (s *session) execute(c *Context) *http.Response {
 	}
 
 	// http method is other than CONNECT
-	if s.serverConn == nil {
-		serverConn, dialErr := s.engine.dialTCP(c.Request.Host)
-		if dialErr != nil {
-			return s.onTCPDialError(c.Request, dialErr)
+	if s.egressKey(c.Request) != s.serverEgressKey {
+		// the connection was opened for another key, e.g., the key of the CONNECT request of intercepted traffic, so
+		// it is opened again from the address selected for the request
+		s.closeServerConn()
+	}
+	if s.serverHTTP2 != nil && (isWebsocketUpgrade(c.Request) || !s.serverHTTP2.CanTakeNewRequest() ||
+		s.egressExcluded(s.serverHTTP2.localAddr)) {
+		// HTTP/2 connections can't be upgraded to websockets, so the handshake is sent using HTTP/1.1
+		s.serverHTTP2 = nil
+	}
+	if s.serverConn == nil && s.serverHTTP2 == nil {
+		if resp := s.dialServer(c.Request); resp != nil {
+			return resp
 		}
-		s.serverConn = serverConn
-		s.serverReader = bufio.NewReader(serverConn)
 	}
 
-	writeErr := c.Request.Write(s.serverConn)
+	urllib.RemoveHopByHopHeaders(c.Request.Header)
+	s.applyForwardingPolicy(c.Request)
+	if c.requestBody != nil {
+		r := c.Request
+		if err := setBody(c.requestBody, r.Header, &r.Body, &r.ContentLength, &r.TransferEncoding); err != nil {
+			return s.onEncodeBodyError(r, err)
+		}
+	}
+	if s.serverHTTP2 != nil {
+		return s.roundTripHTTP2(c.Request)
+	}
+
+	writeErr := s.writeRequest(c.Request)
 	if writeErr != nil {
 		return s.onWriteErr(c.Request, writeErr)
 	}
 
+	// the body was sent, so the client can be watched while waiting for the response
+	s.watch()
+	stopReading := withConnContext(s.requestCtx, s.serverConn)
 	resp, readErr := http.ReadResponse(s.serverReader, c.Request) // TODO: handle read timeout
+	stopReading()
 	if readErr != nil {
-		return s.onReadError(c.Request, readErr)
+		return s.onReadError(c.Request, contextErr(s.requestCtx, readErr))
+	}
+	s.serverClose = resp.Close
+	urllib.RemoveHopByHopHeaders(resp.Header)
+	if s.observeEgress(s.serverConn.LocalAddr(), resp) {
+		s.serverClose = true
 	}
 
 	if isWebsocketUpgrade(c.Request) {
-		s.postRequestAction = s.tunnel
+		if resp.StatusCode == http.StatusSwitchingProtocols && len(s.rule.WebsocketHandlers) > 0 {
+			r, header := c.Request, resp.Header
+			s.postRequestAction = func() error { return s.inspectWebsocket(r, header) }
+		} else {
+			s.postRequestAction = s.tunnel
+		}
 	}
 
 	return resp
 }
 
+// dialServer opens the connection to the origin server for a request that is not preceded by the CONNECT request,
+// which is the case for plain HTTP, streams of HTTP/2 client connections and requests sent after the origin server
+// closed the previous connection. The response is returned if the connection can't be opened.
+func (s *session) dialServer(r *http.Request) *http.Response {
+	if s.scheme == "https" && !s.serverPlaintext {
+		serverConfig, serverConfigErr := s.serverConfigOrDefault()
+		if serverConfigErr != nil {
+			return s.onTLSConfigError(r, serverConfigErr)
+		}
+
+		dialErr := s.dialServerTLS(r, serverConfig)
+		var verificationErr *tls.CertificateVerificationError
+		if errors.As(dialErr, &verificationErr) {
+			return s.onCertificateVerificationFailure(r, verificationErr)
+		}
+		if dialErr != nil {
+			return s.onTCPDialError(r, dialErr)
+		}
+		return nil
+	}
+
+	var serverConn net.Conn
+	var dialErr error
+	ctx, stopWatching := s.dialContext(r)
+	if upstream := s.upstreamProxy(); upstream != nil && upstream.isHTTP() && s.upstreamAddr == "" {
+		// plain HTTP requests are forwarded to the upstream proxy instead of tunneled, unless they are directed to
+		// another address
+		serverConn, dialErr = s.engine.dialUpstream(ctx, upstream)
+		s.forwardProxy = upstream
+	} else {
+		serverConn, dialErr = s.engine.dialTCP(ctx, upstream, s.dialAddr(r))
+	}
+	stopWatching()
+
+	if dialErr != nil {
+		return s.onTCPDialError(r, dialErr)
+	}
+	s.serverConn = serverConn
+	s.serverReader = bufio.NewReader(serverConn)
+	return nil
+}
+
+func (s *session) applyForwardingPolicy(r *http.Request) {
+	viaPseudonym := defaultViaPseudonym
+	if s.engine != nil {
+		viaPseudonym = s.engine.viaPseudonym
+	}
+	applyForwardingPolicy(s.rule.Forwarding, viaPseudonym, r)
+}
+
 func (s *session) onWriteErr(r *http.Request, e error) *http.Response {
 	s.close = true
+	s.err = e
 	withConn(s.logger.Info(), s.serverConn).Err(e).Msg("write")
 	return newHTTP11Response(http.StatusBadGateway, r)
 }
 
 func (s *session) onReadError(r *http.Request, e error) *http.Response {
 	s.close = true
+	s.err = e
 	withConn(s.logger.Info(), s.serverConn).Err(e).Msg("read")
 	return newHTTP11Response(http.StatusBadGateway, r)
 }
 
+func (s *session) onEncodeBodyError(r *http.Request, e error) *http.Response {
+	s.close = true
+	s.err = e
+	s.logger.Error().Err(e).Msg("encode-body")
+	return newHTTP11Response(http.StatusInternalServerError, r)
+}
+
 func (s *session) onCertificateVerificationFailure(r *http.Request, e *tls.CertificateVerificationError) *http.Response {
 	s.close = true
+	s.err = e
 
 	event := s.logger.Error()
 	if len(e.UnverifiedCertificates) > 0 {
@@ -295,12 +806,14 @@ func (s *session) onCertificateVerificationFailure(r *http.Request, e *tls.Certi
 
 func (s *session) onTLSConfigError(r *http.Request, e error) *http.Response {
 	s.close = true
+	s.err = e
 	s.logger.Error().Err(e).Str("host", r.Host).Msg("get-tls-config")
 	return newHTTP11Response(http.StatusInternalServerError, r)
 }
 
 func (s *session) onTCPDialError(r *http.Request, e error) *http.Response {
 	s.close = true
+	s.err = e
 
 	event := s.logger.Info()
 	var networkErr *net.OpError
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout limits the time a client has to send the ClientHello once the tunnel is established
+const clientHelloTimeout = 30 * time.Second
+
+var (
+	errNotTLS             = errors.New("proxy: tunneled connection is not TLS")
+	errServerNameMismatch = errors.New("proxy: server name doesn't match the CONNECT host")
+)
+
+// SNIPolicy controls whether the proxy inspects the TLS ClientHello sent by the client in a tunneled connection. The
+// ClientHello is peeked, so the TLS session is still established between the client and the origin server.
+type SNIPolicy int32
+
+const (
+	// IgnoreSNI tunnels the connection without inspecting it.
+	IgnoreSNI SNIPolicy = iota
+	// LogSNI logs the server name and ALPN protocols sent by the client.
+	LogSNI
+	// EnforceSNI logs the ClientHello and closes the tunnel unless the server name matches the CONNECT host or
+	// one of the allowed server names of the rule. Connections that don't start with the TLS handshake are closed.
+	EnforceSNI
+)
+
+func ParseSNIPolicy(policyName string) (SNIPolicy, error) {
+	if policyName == "" {
+		return IgnoreSNI, nil
+	}
+
+	switch strings.ToUpper(policyName) {
+	case "IGNORE":
+		return IgnoreSNI, nil
+	case "LOG":
+		return LogSNI, nil
+	case "ENFORCE":
+		return EnforceSNI, nil
+	default:
+		return 0, fmt.Errorf("failed to parse SNI policy %q, supported policies are: ignore, log or enforce", policyName)
+	}
+}
+
+// verifyServerName checks the server name sent by the client against the CONNECT host and the allowed server names.
+// A name starting with "*." matches any subdomain. Clients don't send the server name when they connect to an IP
+// address, so the missing name is accepted only if the CONNECT host is an IP address.
+func verifyServerName(serverName, connectHost string, allowedServerNames []string) error {
+	if serverName == "" {
+		if net.ParseIP(connectHost) != nil {
+			return nil
+		}
+		return errServerNameMismatch
+	}
+
+	serverName = strings.TrimSuffix(serverName, ".")
+	if strings.EqualFold(serverName, connectHost) {
+		return nil
+	}
+
+	for _, allowedName := range allowedServerNames {
+		if strings.EqualFold(serverName, allowedName) {
+			return nil
+		}
+
+		if suffix, isWildcard := strings.CutPrefix(allowedName, "*"); isWildcard && strings.HasPrefix(suffix, ".") &&
+			len(serverName) > len(suffix) && strings.EqualFold(serverName[len(serverName)-len(suffix):], suffix) {
+			return nil
+		}
+	}
+
+	return errServerNameMismatch
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSNIPolicy(t *testing.T) {
+	for name, expected := range map[string]SNIPolicy{"": IgnoreSNI, "log": LogSNI, "ENFORCE": EnforceSNI} {
+		policy, err := ParseSNIPolicy(name)
+
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseSNIPolicy("verify")
+	assert.Error(t, err)
+}
+
+func TestVerifyServerName(t *testing.T) {
+	allowed := []string{"api.example.org", "*.example.net"}
+
+	assert.NoError(t, verifyServerName("example.com", "example.com", nil))
+	assert.NoError(t, verifyServerName("Example.COM.", "example.com", nil))
+	assert.NoError(t, verifyServerName("api.example.org", "example.com", allowed))
+	assert.NoError(t, verifyServerName("cdn.example.net", "example.com", allowed))
+	assert.NoError(t, verifyServerName("", "192.0.2.1", nil))
+
+	assert.ErrorIs(t, verifyServerName("evil.com", "example.com", allowed), errServerNameMismatch)
+	assert.ErrorIs(t, verifyServerName("example.net", "example.com", allowed), errServerNameMismatch)
+	assert.ErrorIs(t, verifyServerName("", "example.com", allowed), errServerNameMismatch)
+}
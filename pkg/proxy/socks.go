@@ -0,0 +1,304 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socksVersion         = 0x05
+	socksAuthVersion     = 0x01
+	socksNoAuth          = 0x00
+	socksUserPassAuth    = 0x02
+	socksNoAcceptable    = 0xFF
+	socksConnectCommand  = 0x01
+	socksIPv4Address     = 0x01
+	socksDomainAddress   = 0x03
+	socksIPv6Address     = 0x04
+	socksSucceeded       = 0x00
+	socksGeneralFailure  = 0x01
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	socksTTLExpired      = 0x06
+	socksNotSupported    = 0x07
+	socksBadAddressType  = 0x08
+)
+
+// socksHandshakeTimeout limits the time a client has to negotiate authentication and send the request
+const socksHandshakeTimeout = 30 * time.Second
+
+var (
+	ErrSOCKSServerClosed = errors.New("proxy: SOCKS server closed")
+
+	errSOCKSVersion     = errors.New("socks: unsupported version")
+	errSOCKSAuthMethod  = errors.New("socks: no acceptable authentication method")
+	errSOCKSCredentials = errors.New("socks: invalid credentials")
+)
+
+type SOCKSOptions struct {
+	authenticate func(username, password string) bool
+}
+
+type SOCKSOption func(opts *SOCKSOptions)
+
+// WithSOCKSAuthenticator requires clients to authenticate using the username and password method.
+func WithSOCKSAuthenticator(authenticate func(username, password string) bool) SOCKSOption {
+	return func(opts *SOCKSOptions) {
+		opts.authenticate = authenticate
+	}
+}
+
+// SOCKSServer accepts SOCKS5 connections and handles CONNECT commands using the rules of the engine, so a connection
+// is tunneled, blocked or intercepted in the same way as if the client sent the HTTP CONNECT request.
+type SOCKSServer struct {
+	engine    *Engine
+	options   SOCKSOptions
+	listeners listenerGroup
+}
+
+func NewSOCKSServer(e *Engine, opts ...SOCKSOption) *SOCKSServer {
+	var options SOCKSOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &SOCKSServer{
+		engine:  e,
+		options: options,
+	}
+}
+
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	return s.listeners.serve(s.engine.logger, l, ErrSOCKSServerClosed, s.ServeConn)
+}
+
+// ServeConn negotiates the SOCKS5 session and then handles the connection using the engine.
+func (s *SOCKSServer) ServeConn(conn net.Conn) {
+	tools := s.engine.tools
+	reader := bufio.NewReader(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, handshakeErr := s.handshake(conn, reader)
+	if handshakeErr != nil {
+		withConn(s.engine.logger.Info(), conn).Err(handshakeErr).Msg("socks-handshake")
+		tools.CloseConn(conn)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      HTTP11,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	session, sessionErr := newSession(conn, r, s.engine)
+	if sessionErr != nil {
+		withRemoteAddr(s.engine.logger.Info(), target).Err(sessionErr).Msg("parse-host")
+		_ = writeSOCKSReply(conn, socksGeneralFailure, nil)
+		tools.CloseConn(conn)
+		return
+	}
+
+	session.clientReader = reader
+	session.writeResponse = func(resp *http.Response) error {
+		// requests following the CONNECT command, if any, are answered using HTTP
+		session.writeResponse = nil
+
+		reply := socksReplyCode(resp.StatusCode)
+		if reply != socksSucceeded {
+			session.close = true
+		}
+
+		var boundAddr net.Addr
+		if session.serverConn != nil {
+			boundAddr = session.serverConn.LocalAddr()
+		}
+		return writeSOCKSReply(conn, reply, boundAddr)
+	}
+
+	s.engine.serve(session, r)
+}
+
+func (s *SOCKSServer) handshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksNoAuth)
+	if s.options.authenticate != nil {
+		method = socksUserPassAuth
+	}
+
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errSOCKSAuthMethod
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	if method == socksUserPassAuth {
+		if err := s.authenticate(conn, reader); err != nil {
+			return "", err
+		}
+	}
+
+	return s.readRequest(conn, reader)
+}
+
+func (s *SOCKSServer) authenticate(conn net.Conn, reader *bufio.Reader) error {
+	version, versionErr := reader.ReadByte()
+	if versionErr != nil {
+		return versionErr
+	}
+	if version != socksAuthVersion {
+		return errSOCKSVersion
+	}
+
+	username, usernameErr := readSOCKSString(reader)
+	if usernameErr != nil {
+		return usernameErr
+	}
+
+	password, passwordErr := readSOCKSString(reader)
+	if passwordErr != nil {
+		return passwordErr
+	}
+
+	if !s.options.authenticate(username, password) {
+		_, _ = conn.Write([]byte{socksAuthVersion, 0x01})
+		return errSOCKSCredentials
+	}
+
+	_, writeErr := conn.Write([]byte{socksAuthVersion, 0x00})
+	return writeErr
+}
+
+func (s *SOCKSServer) readRequest(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+
+	if header[1] != socksConnectCommand {
+		_ = writeSOCKSReply(conn, socksNotSupported, nil)
+		return "", fmt.Errorf("socks: unsupported command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksIPv4Address, socksIPv6Address:
+		size := net.IPv4len
+		if header[3] == socksIPv6Address {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomainAddress:
+		domain, domainErr := readSOCKSString(reader)
+		if domainErr != nil {
+			return "", domainErr
+		}
+		host = domain
+	default:
+		_ = writeSOCKSReply(conn, socksBadAddressType, nil)
+		return "", fmt.Errorf("socks: unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Close stops accepting new connections. Connections that are already established are not interrupted.
+func (s *SOCKSServer) Close() error {
+	return s.listeners.Close()
+}
+
+func socksReplyCode(statusCode int) byte {
+	switch statusCode {
+	case http.StatusOK:
+		return socksSucceeded
+	case http.StatusForbidden:
+		return socksNotAllowed
+	case http.StatusBadGateway:
+		return socksHostUnreachable
+	case http.StatusGatewayTimeout:
+		return socksTTLExpired
+	default:
+		return socksGeneralFailure
+	}
+}
+
+func writeSOCKSReply(conn net.Conn, reply byte, boundAddr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcpAddr, ok := boundAddr.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+
+	b := make([]byte, 0, 22)
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksVersion, reply, 0x00, socksIPv4Address)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksVersion, reply, 0x00, socksIPv6Address)
+		b = append(b, ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+
+	_, err := conn.Write(b)
+	return err
+}
+
+func readSOCKSString(reader *bufio.Reader) (string, error) {
+	size, sizeErr := reader.ReadByte()
+	if sizeErr != nil {
+		return "", sizeErr
+	}
+
+	text := make([]byte, size)
+	if _, err := io.ReadFull(reader, text); err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
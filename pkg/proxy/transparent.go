@@ -0,0 +1,262 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// transparentPeekTimeout limits the time a client has to send the first request or the TLS ClientHello
+const transparentPeekTimeout = 30 * time.Second
+
+var (
+	ErrTransparentServerClosed = errors.New("proxy: transparent server closed")
+
+	errNoOriginalDestination = errors.New("proxy: connection was not redirected")
+	errDestinationMismatch   = errors.New("proxy: host doesn't resolve to the destination of the connection")
+)
+
+type TransparentOptions struct {
+	destination func(conn net.Conn) (*net.TCPAddr, error)
+	hostCheck   bool
+}
+
+type TransparentOption func(opts *TransparentOptions)
+
+// WithTransparentDestination overrides how the destination of an intercepted connection is determined. By default,
+// the destination is read using the SO_ORIGINAL_DST socket option. Use LocalAddrDestination for TPROXY.
+func WithTransparentDestination(destination func(conn net.Conn) (*net.TCPAddr, error)) TransparentOption {
+	return func(opts *TransparentOptions) {
+		opts.destination = destination
+	}
+}
+
+// WithTransparentHostCheck closes connections whose host from the SNI extension or the Host header doesn't resolve to
+// the destination, so a client can't select the rule of another host by sending its name. The host is resolved using
+// static hosts of the rule and the resolver of the engine, or the resolver of the system, which delays every
+// connection by the lookup. Hosts that resolve to a varying subset of addresses, e.g., behind a CDN, may be rejected.
+func WithTransparentHostCheck() TransparentOption {
+	return func(opts *TransparentOptions) {
+		opts.hostCheck = true
+	}
+}
+
+// LocalAddrDestination returns the local address of a connection, which is the original destination of connections
+// accepted on a socket configured with the TPROXY target.
+func LocalAddrDestination(conn net.Conn) (*net.TCPAddr, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errNoOriginalDestination
+	}
+	return addr, nil
+}
+
+// TransparentServer accepts connections redirected to the proxy by the firewall. Clients are unaware of the proxy, so
+// the destination is read from the socket. TLS connections are handled as if the client sent the CONNECT request to
+// the host from the SNI extension, whereas plain HTTP requests are handled as if they were sent to a forward proxy.
+// The rule is selected by the host sent by the client, unless WithTransparentHostCheck is set.
+type TransparentServer struct {
+	engine    *Engine
+	options   TransparentOptions
+	listeners listenerGroup
+}
+
+func NewTransparentServer(e *Engine, opts ...TransparentOption) *TransparentServer {
+	options := TransparentOptions{
+		destination: OriginalDestination,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &TransparentServer{
+		engine:  e,
+		options: options,
+	}
+}
+
+func (s *TransparentServer) Serve(l net.Listener) error {
+	return s.listeners.serve(s.engine.logger, l, ErrTransparentServerClosed, s.ServeConn)
+}
+
+// ServeConn determines the destination and the protocol of the connection and then handles it using the engine.
+func (s *TransparentServer) ServeConn(conn net.Conn) {
+	tools := s.engine.tools
+
+	dst, dstErr := s.options.destination(conn)
+	if dstErr != nil {
+		withConn(s.engine.logger.Info(), conn).Err(dstErr).Msg("original-destination")
+		tools.CloseConn(conn)
+		return
+	}
+
+	reader := bufio.NewReaderSize(conn, clientHelloPeekCapacity)
+	clientConn := &bufferedConn{Conn: conn, reader: reader}
+
+	_ = conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	r, requestErr := s.readRequest(reader, dst)
+	if requestErr != nil {
+		withConn(s.engine.logger.Info(), conn).Err(requestErr).Msg("transparent-request")
+		tools.CloseConn(conn)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	r.RemoteAddr = conn.RemoteAddr().String()
+
+	host := r.Host
+	if r.Method != http.MethodConnect {
+		// the session requires the port, whereas the origin should receive the Host header sent by the client
+		r.Host = net.JoinHostPort(requestHostname(r, dst), strconv.Itoa(dst.Port))
+	}
+
+	if s.options.hostCheck {
+		hostname, _, _ := net.SplitHostPort(r.Host)
+		if verifyErr := s.verifyDestination(hostname, dst); verifyErr != nil {
+			withConn(s.engine.logger.Info(), conn).Err(verifyErr).Str("host", hostname).Msg("transparent-destination")
+			tools.CloseConn(conn)
+			return
+		}
+	}
+
+	session, sessionErr := newSession(clientConn, r, s.engine)
+	if sessionErr != nil {
+		withRemoteAddr(s.engine.logger.Info(), r.Host).Err(sessionErr).Msg("parse-host")
+		tools.CloseConn(conn)
+		return
+	}
+	session.clientReader = reader
+	session.upstreamAddr = dst.String()
+
+	if r.Method == http.MethodConnect {
+		session.writeResponse = func(resp *http.Response) error {
+			// the client didn't send the CONNECT request, so it can't receive the response
+			session.writeResponse = nil
+			if resp.StatusCode != http.StatusOK {
+				session.close = true
+			}
+			return nil
+		}
+	} else {
+		r.Host = host
+		r.URL.Scheme = session.scheme
+		r.URL.Host = session.serverRemoteAddr
+	}
+
+	s.engine.serve(session, r)
+}
+
+// readRequest peeks the first bytes sent by the client. TLS connections are represented as CONNECT requests to the
+// server name, otherwise the HTTP request is read.
+func (s *TransparentServer) readRequest(reader *bufio.Reader, dst *net.TCPAddr) (*http.Request, error) {
+	if !isTLSHandshake(reader) {
+		return http.ReadRequest(reader)
+	}
+
+	hello, helloErr := peekClientHello(reader)
+	if helloErr != nil {
+		return nil, helloErr
+	}
+
+	hostname := hello.serverName
+	if hostname == "" {
+		hostname = dst.IP.String()
+	}
+	target := net.JoinHostPort(hostname, strconv.Itoa(dst.Port))
+
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      HTTP11,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}, nil
+}
+
+// verifyDestination checks the host the client asked for resolves to the destination of the connection. The
+// connection is dialed to the destination, whereas the rule is selected by the host, which is sent by the client.
+func (s *TransparentServer) verifyDestination(hostname string, dst *net.TCPAddr) error {
+	dstAddr, _ := netip.AddrFromSlice(dst.IP)
+	dstAddr = dstAddr.Unmap()
+
+	var addrs []netip.Addr
+	if addr, parseErr := netip.ParseAddr(hostname); parseErr == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		ctx, cancel := context.WithTimeout(s.engine.ctx, s.engine.dialTimeout)
+		defer cancel()
+
+		var lookupErr error
+		addrs, lookupErr = s.engine.lookupHost(ctx, hostname)
+		if lookupErr != nil {
+			return lookupErr
+		}
+	}
+
+	for _, addr := range addrs {
+		if addr.Unmap() == dstAddr {
+			return nil
+		}
+	}
+	return errDestinationMismatch
+}
+
+// Close stops accepting new connections. Connections that are already established are not interrupted.
+func (s *TransparentServer) Close() error {
+	return s.listeners.Close()
+}
+
+// requestHostname returns the host name from the Host header or the IP address of the destination if the header is
+// missing
+func requestHostname(r *http.Request, dst *net.TCPAddr) string {
+	if r.Host == "" {
+		return dst.IP.String()
+	}
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		return hostname
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+}
+
+// bufferedConn replays bytes peeked from the connection before they are read from the connection itself
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// syscallConn unwraps the connection until it reaches the connection that exposes the file descriptor
+func syscallConn(conn net.Conn) (syscall.RawConn, error) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case syscall.Conn:
+			return c.SyscallConn()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, errNotSupported
+		}
+	}
+	return nil, errNotSupported
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/pmateusz/glove/internal/acl"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// DirectUpstream is used by rules that connect to origin servers directly regardless of the default upstream proxy.
+var DirectUpstream = &UpstreamProxy{}
+
+// UpstreamProxy is a parent proxy used to reach origin servers. HTTP and HTTPS proxies are asked to open a tunnel using
+// the CONNECT method, except for plain HTTP requests, which are forwarded to the proxy. SOCKS5 proxies are asked to
+// open a tunnel using the CONNECT command, host names of origin servers are resolved locally for the socks5 scheme
+// and by the proxy for the socks5h scheme.
+type UpstreamProxy struct {
+	url       *url.URL
+	tlsConfig *tls.Config
+
+	noProxyAll     bool
+	noProxyIPs     *acl.Trie
+	noProxyDomains []noProxyDomain
+}
+
+type noProxyDomain struct {
+	name string
+	port string
+}
+
+type UpstreamProxyOption func(u *UpstreamProxy) error
+
+// WithUpstreamTLSConfig sets the TLS configuration used to connect to an HTTPS proxy.
+func WithUpstreamTLSConfig(config *tls.Config) UpstreamProxyOption {
+	return func(u *UpstreamProxy) error {
+		u.tlsConfig = config
+		return nil
+	}
+}
+
+// WithNoProxy excludes origin servers from using the upstream proxy. Entries follow the NO_PROXY convention: "*"
+// matches all hosts, an IP address or a CIDR mask matches IP addresses, and a domain name matches the domain and
+// its subdomains. Domain names may be followed by a port.
+func WithNoProxy(entries ...string) UpstreamProxyOption {
+	return func(u *UpstreamProxy) error {
+		for _, value := range entries {
+			for _, entry := range strings.Split(value, ",") {
+				if err := u.addNoProxy(strings.ToLower(strings.TrimSpace(entry))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// NewUpstreamProxy creates an upstream proxy from the URL with the http, https, socks5 or socks5h scheme. User information in
+// the URL is sent to the proxy using the basic authentication for HTTP proxies and the username and password
+// authentication for SOCKS5 proxies.
+func NewUpstreamProxy(rawURL string, opts ...UpstreamProxyOption) (*UpstreamProxy, error) {
+	proxyURL, parseErr := url.Parse(rawURL)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("failed to parse upstream proxy %q, supported schemes are: http, https, socks5 or socks5h", proxyURL.Redacted())
+	}
+
+	if proxyURL.Port() == "" {
+		port := "1080"
+		if proxyURL.Scheme == "http" {
+			port = "80"
+		} else if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	u := &UpstreamProxy{
+		url:        proxyURL,
+		noProxyIPs: acl.NewTrie(),
+	}
+	for _, opt := range opts {
+		if err := opt(u); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (u *UpstreamProxy) addNoProxy(entry string) error {
+	if entry == "" {
+		return nil
+	}
+	if entry == "*" {
+		u.noProxyAll = true
+		return nil
+	}
+
+	if strings.IndexByte(entry, '/') >= 0 {
+		prefix, prefixErr := acl.ParsePrefix(entry)
+		if prefixErr != nil {
+			return fmt.Errorf("failed to parse the no proxy entry %q as CIDR address", entry)
+		}
+		u.noProxyIPs.Insert(prefix)
+		return nil
+	}
+
+	host, port, splitErr := net.SplitHostPort(entry)
+	if splitErr != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"), ""
+	}
+
+	if addr, addrErr := netip.ParseAddr(host); addrErr == nil {
+		u.noProxyIPs.Insert(netip.PrefixFrom(addr, addr.BitLen()))
+		return nil
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	u.noProxyDomains = append(u.noProxyDomains, noProxyDomain{name: name, port: port})
+	return nil
+}
+
+// excludes reports whether the origin server should be reached without the upstream proxy
+func (u *UpstreamProxy) excludes(addr string) bool {
+	if u.url == nil || u.noProxyAll {
+		return true
+	}
+
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		host = addr
+	}
+
+	if ip, parseErr := netip.ParseAddr(host); parseErr == nil {
+		return u.noProxyIPs.Contains(ip)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range u.noProxyDomains {
+		if domain.port != "" && domain.port != port {
+			continue
+		}
+		if host == domain.name || strings.HasSuffix(host, "."+domain.name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UpstreamProxy) String() string {
+	if u.url == nil {
+		return "direct"
+	}
+	return u.url.Redacted()
+}
+
+// isHTTP reports whether the upstream proxy accepts plain HTTP requests in the absolute form
+func (u *UpstreamProxy) isHTTP() bool {
+	return u.url.Scheme == "http" || u.url.Scheme == "https"
+}
+
+func (u *UpstreamProxy) authorization() string {
+	if u.url.User == nil {
+		return ""
+	}
+
+	password, _ := u.url.User.Password()
+	credentials := u.url.User.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// dialProxy opens a connection to the upstream proxy
+func (u *UpstreamProxy) dialProxy(ctx context.Context, dialer Dialer) (net.Conn, error) {
+	conn, dialErr := dialer.DialContext(ctx, "tcp", u.url.Host)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	if u.url.Scheme != "https" {
+		return conn, nil
+	}
+
+	config := &tls.Config{}
+	if u.tlsConfig != nil {
+		config = u.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.url.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if handshakeErr := tlsConn.HandshakeContext(ctx); handshakeErr != nil {
+		_ = conn.Close()
+		return nil, handshakeErr
+	}
+	return tlsConn, nil
+}
+
+// dial opens a tunnel to the origin server through the upstream proxy, lookup resolves host names sent to SOCKS5
+// proxies using the socks5 scheme
+func (u *UpstreamProxy) dial(ctx context.Context, dialer Dialer, lookup func(context.Context, string) ([]netip.Addr, error), addr string) (net.Conn, error) {
+	if !u.isHTTP() {
+		if u.url.Scheme == "socks5" {
+			resolved, resolveErr := resolveAddr(ctx, lookup, addr)
+			if resolveErr != nil {
+				return nil, resolveErr
+			}
+			addr = resolved
+		}
+
+		var auth *proxy.Auth
+		if u.url.User != nil {
+			password, _ := u.url.User.Password()
+			auth = &proxy.Auth{User: u.url.User.Username(), Password: password}
+		}
+
+		socksDialer, socksErr := proxy.SOCKS5("tcp", u.url.Host, auth, forwardDialer{dialer})
+		if socksErr != nil {
+			return nil, socksErr
+		}
+		return socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	conn, dialErr := u.dialProxy(ctx, dialer)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	tunnelConn, connectErr := u.connect(ctx, conn, addr)
+	if connectErr != nil {
+		_ = conn.Close()
+		return nil, contextErr(ctx, connectErr)
+	}
+	return tunnelConn, nil
+}
+
+// resolveAddr replaces the host name of the address with its first IP address
+func resolveAddr(ctx context.Context, lookup func(context.Context, string) ([]netip.Addr, error), addr string) (string, error) {
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		return "", splitErr
+	}
+	if _, parseErr := netip.ParseAddr(host); parseErr == nil {
+		return addr, nil
+	}
+
+	addrs, lookupErr := lookup(ctx, host)
+	if lookupErr != nil {
+		return "", lookupErr
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	return net.JoinHostPort(addrs[0].Unmap().String(), port), nil
+}
+
+func (u *UpstreamProxy) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	r := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if authorization := u.authorization(); authorization != "" {
+		r.Header.Set("Proxy-Authorization", authorization)
+	}
+
+	stop := withConnContext(ctx, conn)
+	defer stop()
+
+	if writeErr := r.Write(conn); writeErr != nil {
+		return nil, writeErr
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, readErr := http.ReadResponse(reader, r)
+	if readErr != nil {
+		return nil, readErr
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream proxy %s: CONNECT %s: %s", u, addr, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// websocketCloseTimeout is how long the proxy waits for the peer to answer the close message before the connections
+// are closed
+const websocketCloseTimeout = 5 * time.Second
+
+type WebsocketDirection int32
+
+const (
+	ClientToServer WebsocketDirection = iota
+	ServerToClient
+)
+
+func (d WebsocketDirection) String() string {
+	if d == ClientToServer {
+		return "client-to-server"
+	}
+	return "server-to-client"
+}
+
+// WebsocketMessageType is the opcode of the message, see RFC 6455 11.8
+type WebsocketMessageType byte
+
+const (
+	websocketContinuation WebsocketMessageType = 0
+	WebsocketText         WebsocketMessageType = 1
+	WebsocketBinary       WebsocketMessageType = 2
+	WebsocketClose        WebsocketMessageType = 8
+	WebsocketPing         WebsocketMessageType = 9
+	WebsocketPong         WebsocketMessageType = 10
+)
+
+// WebsocketMessage is the complete message assembled from frames. The data of compressed messages is decompressed.
+type WebsocketMessage struct {
+	Direction WebsocketDirection
+	Type      WebsocketMessageType
+	Data      []byte
+}
+
+type WebsocketHandler func(c *WebsocketContext)
+
+// WebsocketContext is passed to websocket handlers for every message. Handlers can change the message, drop it by
+// returning without calling Next or send other messages in both directions.
+type WebsocketContext struct {
+	// Request is the handshake request of the websocket
+	Request *http.Request
+	Message *WebsocketMessage
+
+	ws        *websocketSession
+	callDepth int
+}
+
+func (c *WebsocketContext) Next() {
+	defer func() {
+		if r := recover(); r != nil {
+			c.ws.s.logger.Error().Str("panic", fmt.Sprintf("%v", r)).Msg("recovered")
+		}
+	}()
+
+	if c.callDepth < len(c.ws.handlers) {
+		h := c.ws.handlers[c.callDepth]
+		c.callDepth += 1
+		h(c)
+		return
+	}
+
+	if err := c.ws.send(c.Message); err != nil {
+		c.ws.s.logger.Info().Err(err).Stringer("direction", c.Message.Direction).Msg("websocket-write")
+	}
+}
+
+// Send writes the message in its direction without passing it to handlers.
+func (c *WebsocketContext) Send(message *WebsocketMessage) error {
+	return c.ws.send(message)
+}
+
+// websocketSession forwards messages between the client and the origin server once the websocket handshake succeeds
+type websocketSession struct {
+	s        *session
+	request  *http.Request
+	handlers []WebsocketHandler
+
+	clientMu sync.Mutex
+	serverMu sync.Mutex
+}
+
+// inspectWebsocket passes websocket messages to websocket handlers of the rule instead of copying bytes. Messages are
+// forwarded uncompressed, which is allowed by the permessage-deflate extension.
+func (s *session) inspectWebsocket(r *http.Request, header http.Header) error {
+	ws := &websocketSession{s: s, request: r, handlers: s.rule.WebsocketHandlers}
+	deflate, serverContextTakeover, clientContextTakeover := websocketDeflate(header)
+	defer withConnContext(s.ctx, s.clientConn)()
+	defer withConnContext(s.ctx, s.serverConn)()
+
+	// frames are written to the counting connections, so the tunnel close hooks receive the bytes sent in each
+	// direction
+	clientConn, serverConn := &countingConn{Conn: s.clientConn}, &countingConn{Conn: s.serverConn}
+	s.clientConn, s.serverConn = clientConn, serverConn
+	defer func() { s.clientConn, s.serverConn = clientConn.Conn, serverConn.Conn }()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		reader := &websocketReader{reader: s.clientReader, deflate: deflate, contextTakeover: clientContextTakeover}
+		ws.pump(ClientToServer, reader, s.clientConn, s.serverConn)
+	}()
+	go func() {
+		defer wg.Done()
+		reader := &websocketReader{reader: s.serverReader, deflate: deflate, contextTakeover: serverContextTakeover}
+		ws.pump(ServerToClient, reader, s.serverConn, s.clientConn)
+	}()
+	wg.Wait()
+
+	s.tunnelStats = &TunnelStats{
+		BytesSent:     serverConn.written.Load(),
+		BytesReceived: clientConn.written.Load(),
+		Duration:      time.Since(start),
+	}
+	s.close = true
+	return nil
+}
+
+// countingConn counts the bytes written to the connection
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// pump reads messages from the source until the connection fails or the close message is received. Once the pump
+// stops, the destination is given time to answer the close message, so the other pump stops too.
+func (ws *websocketSession) pump(direction WebsocketDirection, reader *websocketReader, source, dest net.Conn) {
+	timeout := time.Duration(0)
+	defer func() { _ = dest.SetReadDeadline(time.Now().Add(timeout)) }()
+
+	for {
+		messageType, data, readErr := reader.readMessage()
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) && !errors.Is(readErr, net.ErrClosed) &&
+				!errors.Is(readErr, os.ErrDeadlineExceeded) {
+				withConn(ws.s.logger.Info(), source).Err(readErr).Stringer("direction", direction).Msg("websocket-read")
+			}
+			return
+		}
+
+		c := &WebsocketContext{
+			Request: ws.request,
+			Message: &WebsocketMessage{Direction: direction, Type: messageType, Data: data},
+			ws:      ws,
+		}
+		c.Next()
+
+		if messageType == WebsocketClose {
+			timeout = websocketCloseTimeout
+			return
+		}
+	}
+}
+
+func (ws *websocketSession) send(message *WebsocketMessage) error {
+	if message.Direction == ClientToServer {
+		ws.serverMu.Lock()
+		defer ws.serverMu.Unlock()
+		return writeWebsocketFrame(ws.s.serverConn, message.Type, message.Data, true)
+	}
+
+	ws.clientMu.Lock()
+	defer ws.clientMu.Unlock()
+	return writeWebsocketFrame(ws.s.clientConn, message.Type, message.Data, false)
+}
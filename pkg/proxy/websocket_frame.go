@@ -0,0 +1,259 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxWebsocketMessageSize limits the size of a message assembled from frames, including decompressed messages
+	maxWebsocketMessageSize = 16 << 20
+	// maxControlFramePayload is the largest payload of the close, ping and pong frames, see RFC 6455 5.5
+	maxControlFramePayload = 125
+	// deflateWindowSize is the size of the LZ77 sliding window kept between messages with the context takeover
+	deflateWindowSize = 32 << 10
+)
+
+var (
+	errWebsocketMessageTooBig = errors.New("proxy: websocket message is too big")
+	errWebsocketProtocol      = errors.New("proxy: websocket protocol error")
+)
+
+// deflateTail ends the message compressed using permessage-deflate with the empty stored block removed by the sender
+// and the final empty block, so the reader reaches the end of the stream, see RFC 7692 7.2.2
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+type websocketFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  WebsocketMessageType
+	payload []byte
+}
+
+func (f *websocketFrame) isControl() bool {
+	return f.opcode >= WebsocketClose
+}
+
+// readWebsocketFrame reads the frame and unmasks its payload, see RFC 6455 5.2
+func readWebsocketFrame(r io.Reader, maxPayload int64) (*websocketFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := &websocketFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv1:   header[0]&0x40 != 0,
+		opcode: WebsocketMessageType(header[0] & 0x0f),
+	}
+	if header[0]&0x30 != 0 {
+		return nil, fmt.Errorf("%w: reserved bits are set", errWebsocketProtocol)
+	}
+
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if frame.isControl() && (length > maxControlFramePayload || !frame.fin) {
+		return nil, fmt.Errorf("%w: invalid control frame", errWebsocketProtocol)
+	}
+	if length > uint64(maxPayload) {
+		return nil, errWebsocketMessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(mask, frame.payload)
+	}
+	return frame, nil
+}
+
+// writeWebsocketFrame writes the unfragmented frame. Frames sent by clients must be masked, see RFC 6455 5.3
+func writeWebsocketFrame(w io.Writer, opcode WebsocketMessageType, payload []byte, masked bool) error {
+	if opcode >= WebsocketClose && len(payload) > maxControlFramePayload {
+		return fmt.Errorf("%w: control frame payload exceeds %d bytes", errWebsocketProtocol, maxControlFramePayload)
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// websocketReader assembles messages from frames received in one direction. Control frames can be interleaved with
+// fragments of a data message, so they are returned before the data message is complete.
+type websocketReader struct {
+	reader *bufio.Reader
+
+	// deflate is set if permessage-deflate was negotiated
+	deflate bool
+	// contextTakeover keeps the sliding window between compressed messages
+	contextTakeover bool
+	window          []byte
+
+	fragments  []byte
+	fragmented bool
+	opcode     WebsocketMessageType
+	compressed bool
+}
+
+func (r *websocketReader) readMessage() (WebsocketMessageType, []byte, error) {
+	for {
+		frame, frameErr := readWebsocketFrame(r.reader, maxWebsocketMessageSize-int64(len(r.fragments)))
+		if frameErr != nil {
+			return 0, nil, frameErr
+		}
+
+		if frame.isControl() {
+			return frame.opcode, frame.payload, nil
+		}
+
+		switch {
+		case frame.opcode == websocketContinuation && !r.fragmented:
+			return 0, nil, fmt.Errorf("%w: unexpected continuation frame", errWebsocketProtocol)
+		case frame.opcode != websocketContinuation && r.fragmented:
+			return 0, nil, fmt.Errorf("%w: expected continuation frame", errWebsocketProtocol)
+		case frame.opcode != websocketContinuation:
+			r.opcode = frame.opcode
+			r.compressed = frame.rsv1
+			if frame.rsv1 && !r.deflate {
+				return 0, nil, fmt.Errorf("%w: compressed message without permessage-deflate", errWebsocketProtocol)
+			}
+		}
+
+		if frame.fin && !r.fragmented {
+			return r.complete(frame.payload)
+		}
+
+		r.fragmented = true
+		r.fragments = append(r.fragments, frame.payload...)
+		if frame.fin {
+			payload := r.fragments
+			r.fragments, r.fragmented = nil, false
+			return r.complete(payload)
+		}
+	}
+}
+
+func (r *websocketReader) complete(payload []byte) (WebsocketMessageType, []byte, error) {
+	if !r.compressed {
+		return r.opcode, payload, nil
+	}
+
+	var dict []byte
+	if r.contextTakeover {
+		dict = r.window
+	}
+	reader := flate.NewReaderDict(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)), dict)
+	data, readErr := io.ReadAll(io.LimitReader(reader, maxWebsocketMessageSize+1))
+	if readErr != nil {
+		return 0, nil, readErr
+	}
+	if len(data) > maxWebsocketMessageSize {
+		return 0, nil, errWebsocketMessageTooBig
+	}
+
+	if r.contextTakeover {
+		r.window = append(r.window, data...)
+		if len(r.window) > deflateWindowSize {
+			r.window = append([]byte(nil), r.window[len(r.window)-deflateWindowSize:]...)
+		}
+	}
+	return r.opcode, data, nil
+}
+
+// websocketDeflate returns whether permessage-deflate was negotiated in the handshake response and whether the server
+// and the client keep the sliding window between messages, see RFC 7692 7.1
+func websocketDeflate(header http.Header) (enabled, serverContextTakeover, clientContextTakeover bool) {
+	for _, value := range header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			params := strings.Split(extension, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+
+			enabled, serverContextTakeover, clientContextTakeover = true, true, true
+			for _, param := range params[1:] {
+				switch strings.TrimSpace(param) {
+				case "server_no_context_takeover":
+					serverContextTakeover = false
+				case "client_no_context_takeover":
+					clientContextTakeover = false
+				}
+			}
+			return
+		}
+	}
+	return
+}
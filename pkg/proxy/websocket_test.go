@@ -0,0 +1,130 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// compressMessage compresses the message as a sender using permessage-deflate with the context takeover
+func compressMessage(t *testing.T, writer *flate.Writer, buffer *bytes.Buffer, message string) []byte {
+	buffer.Reset()
+	_, writeErr := writer.Write([]byte(message))
+	require.NoError(t, writeErr)
+	require.NoError(t, writer.Flush())
+	return bytes.TrimSuffix(buffer.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+func TestWebsocketFrameRoundTrip(t *testing.T) {
+	for _, length := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			// GIVEN
+			payload := bytes.Repeat([]byte{'x'}, length)
+			var buffer bytes.Buffer
+
+			// WHEN
+			writeErr := writeWebsocketFrame(&buffer, WebsocketBinary, payload, masked)
+			frame, readErr := readWebsocketFrame(&buffer, maxWebsocketMessageSize)
+
+			// THEN
+			require.NoError(t, writeErr)
+			require.NoError(t, readErr)
+			assert.True(t, frame.fin)
+			assert.Equal(t, WebsocketBinary, frame.opcode)
+			assert.Equal(t, payload, frame.payload)
+		}
+	}
+}
+
+func TestWebsocketFrameMasking(t *testing.T) {
+	// GIVEN
+	var buffer bytes.Buffer
+
+	// WHEN
+	writeErr := writeWebsocketFrame(&buffer, WebsocketText, []byte("hello"), true)
+
+	// THEN
+	require.NoError(t, writeErr)
+	frame := buffer.Bytes()
+	assert.Equal(t, byte(0x80|5), frame[1])
+	assert.NotEqual(t, []byte("hello"), frame[6:])
+}
+
+func TestWebsocketReaderAssemblesFragments(t *testing.T) {
+	// GIVEN
+	stream := []byte{
+		0x01, 0x03, 'f', 'o', 'o', // text, not final
+		0x89, 0x04, 'p', 'i', 'n', 'g', // ping interleaved with fragments
+		0x80, 0x03, 'b', 'a', 'r', // continuation, final
+	}
+	reader := &websocketReader{reader: bufio.NewReader(bytes.NewReader(stream))}
+
+	// WHEN
+	pingType, ping, pingErr := reader.readMessage()
+	textType, text, textErr := reader.readMessage()
+
+	// THEN
+	require.NoError(t, pingErr)
+	assert.Equal(t, WebsocketPing, pingType)
+	assert.Equal(t, "ping", string(ping))
+	require.NoError(t, textErr)
+	assert.Equal(t, WebsocketText, textType)
+	assert.Equal(t, "foobar", string(text))
+}
+
+func TestWebsocketReaderInflatesMessagesWithContextTakeover(t *testing.T) {
+	// GIVEN
+	var compressed, stream bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	for _, message := range []string{"repeated message", "repeated message"} {
+		payload := compressMessage(t, writer, &compressed, message)
+		stream.WriteByte(0x80 | 0x40 | byte(WebsocketText))
+		stream.WriteByte(byte(len(payload)))
+		stream.Write(payload)
+	}
+	reader := &websocketReader{reader: bufio.NewReader(&stream), deflate: true, contextTakeover: true}
+
+	for i := 0; i < 2; i++ {
+		// WHEN
+		messageType, data, readErr := reader.readMessage()
+
+		// THEN
+		require.NoError(t, readErr)
+		assert.Equal(t, WebsocketText, messageType)
+		assert.Equal(t, "repeated message", string(data))
+	}
+}
+
+func TestWebsocketReaderRejectsTooBigMessage(t *testing.T) {
+	// GIVEN
+	header := []byte{0x82, 127, 0, 0, 0, 0, 0x10, 0, 0, 1}
+	reader := &websocketReader{reader: bufio.NewReader(bytes.NewReader(header))}
+
+	// WHEN
+	_, _, readErr := reader.readMessage()
+
+	// THEN
+	assert.ErrorIs(t, readErr, errWebsocketMessageTooBig)
+}
+
+func TestWebsocketDeflate(t *testing.T) {
+	// GIVEN
+	header := http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; server_no_context_takeover"}}
+
+	// WHEN
+	enabled, serverContextTakeover, clientContextTakeover := websocketDeflate(header)
+
+	// THEN
+	assert.True(t, enabled)
+	assert.False(t, serverContextTakeover)
+	assert.True(t, clientContextTakeover)
+}
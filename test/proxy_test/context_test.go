@@ -0,0 +1,265 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWaitingRule returns the rule whose handler waits until the context of the request is done and sends its error
+func newWaitingRule(started chan<- struct{}, errs chan<- error) *proxy.Rule {
+	return &proxy.Rule{Handlers: []proxy.Handler{func(c *proxy.Context) {
+		close(started)
+		select {
+		case <-c.Ctx().Done():
+			errs <- c.Ctx().Err()
+		case <-time.After(5 * time.Second):
+			errs <- nil
+		}
+		c.Response = &http.Response{ProtoMajor: 1, ProtoMinor: 1, StatusCode: http.StatusServiceUnavailable}
+	}}}
+}
+
+func TestHTTPProxyCancelsContextWhenClientDisconnects(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	started, errs := make(chan struct{}), make(chan error, 1)
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithRule(newWaitingRule(started, errs), localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	clientConn, dialErr := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, dialErr)
+	_, writeErr := fmt.Fprintf(clientConn, "GET %s/echo HTTP/1.1\r\nHost: %s\r\n\r\n", server.URL, server.Listener.Addr())
+	require.NoError(t, writeErr)
+	<-started
+
+	// WHEN
+	require.NoError(t, clientConn.Close())
+
+	// THEN
+	assert.ErrorIs(t, <-errs, context.Canceled)
+}
+
+func TestHTTPProxyCancelsContextWhenEngineIsClosed(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	started, errs := make(chan struct{}), make(chan error, 1)
+	engine := proxy.NewEngine(proxy.WithRule(newWaitingRule(started, errs), localhost), proxy.WithLogger(zerolog.Nop()))
+	proxyServer := httptest.NewServer(engine)
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := tools.HTTPEcho(server.URL, "shutdown")
+		if assert.NoError(t, err) {
+			_ = resp.Body.Close()
+			responses <- resp
+		}
+	}()
+	<-started
+
+	// WHEN
+	require.NoError(t, engine.Close())
+
+	// THEN
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	resp := <-responses
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
+
+func TestHTTPProxyClosesTunnelWhenEngineIsClosed(t *testing.T) {
+	// GIVEN
+	listener, listenErr := net.Listen("tcp", localhost+":0")
+	require.NoError(t, listenErr)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		// the server accepts the connection and never closes it
+		conn, acceptErr := listener.Accept()
+		if acceptErr == nil {
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	engine := proxy.NewEngine(proxy.WithLogger(zerolog.Nop()))
+	proxyServer := httptest.NewServer(engine)
+	defer proxyServer.Close()
+	clientConn, dialErr := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, dialErr)
+	defer func() { _ = clientConn.Close() }()
+	addr := listener.Addr().String()
+	_, writeErr := fmt.Fprintf(clientConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	require.NoError(t, writeErr)
+	status, readErr := bufio.NewReader(clientConn).ReadString('\n')
+	require.NoError(t, readErr)
+	require.True(t, strings.HasPrefix(status, "HTTP/1.0 200"), status)
+
+	// WHEN
+	require.NoError(t, engine.Close())
+
+	// THEN
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, tunnelErr := io.ReadAll(clientConn)
+	assert.NoError(t, tunnelErr)
+}
+
+var (
+	principalKey = proxy.NewLoggableAttributeKey[string]("principal")
+	signedKey    = proxy.NewAttributeKey[bool]("signed")
+)
+
+func TestHTTPSProxySharesSessionAttributesWithInterceptedRequests(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	var mu sync.Mutex
+	var principals []string
+	var signed []bool
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{
+		func(c *proxy.Context) {
+			// authenticates the client using the CONNECT request
+			if c.Request.Method == http.MethodConnect {
+				principalKey.SetSession(c, c.Request.Header.Get("X-Principal"))
+			} else {
+				signedKey.Set(c, true)
+			}
+			c.Next()
+		},
+		func(c *proxy.Context) {
+			if c.Request.Method != http.MethodConnect {
+				name, _ := principalKey.Get(c)
+				isSigned, _ := signedKey.Get(c)
+				mu.Lock()
+				principals = append(principals, name)
+				signed = append(signed, isSigned)
+				mu.Unlock()
+			}
+			c.Next()
+		},
+	}}
+	logs := &logRecorder{}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		proxy.WithRule(rule, localhost),
+		proxy.WithAccessLog(),
+		proxy.WithLogger(zerolog.New(logs))))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	tools.transport.ProxyConnectHeader = http.Header{"X-Principal": {"alice"}}
+
+	// WHEN
+	tools.AssertHTTPEcho(server.URL, "first")
+	tools.AssertHTTPEcho(server.URL, "second")
+
+	// THEN
+	assert.Equal(t, []string{"alice", "alice"}, principals)
+	assert.Equal(t, []bool{true, true}, signed)
+	assert.Contains(t, logs.String(), `"method":"CONNECT"`)
+	assert.Contains(t, logs.String(), `"method":"GET","host":"`+server.Listener.Addr().String()+`","path":"/echo","proto":"HTTP/1.1","status":200`)
+	assert.Contains(t, logs.String(), `"principal":"alice","message":"access"`)
+	assert.NotContains(t, logs.String(), `"signed"`)
+}
+
+// newGzipEchoServer returns the server that echoes the compressed body of the request and checks its Content-Length
+func newGzipEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+		w.Header().Set("Content-Encoding", r.Header.Get("Content-Encoding"))
+		_, _ = w.Write(body)
+	}))
+}
+
+func gzipBody(t *testing.T, data string) *bytes.Buffer {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return &buffer
+}
+
+func TestHTTPProxyRewritesCompressedBodies(t *testing.T) {
+	// GIVEN
+	server := newGzipEchoServer(t)
+	defer server.Close()
+	rule := &proxy.Rule{Handlers: []proxy.Handler{func(c *proxy.Context) {
+		requestBody, requestErr := c.RequestBody()
+		require.NoError(t, requestErr)
+		data, _ := requestBody.Bytes()
+		require.NoError(t, requestBody.Replace(append(data, " request"...)))
+		c.Next()
+		responseBody, responseErr := c.ResponseBody()
+		require.NoError(t, responseErr)
+		data, _ = responseBody.Bytes()
+		require.NoError(t, responseBody.Replace(append(data, " response"...)))
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	tools.transport.DisableCompression = true
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/echo", gzipBody(t, "hello"))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	// WHEN
+	resp, err := (&http.Client{Transport: tools.transport}).Do(req)
+
+	// THEN
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	reader, readerErr := gzip.NewReader(resp.Body)
+	require.NoError(t, readerErr)
+	data, readErr := io.ReadAll(reader)
+	require.NoError(t, readErr)
+	assert.Equal(t, "hello request response", string(data))
+}
+
+func TestHTTPProxyRejectsTooLargeBody(t *testing.T) {
+	// GIVEN
+	server := newGzipEchoServer(t)
+	defer server.Close()
+	rule := &proxy.Rule{MaxBodySize: 100, BodyMemorySize: 10, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if _, err := c.RequestBody(); errors.Is(err, proxy.ErrBodyTooLarge) {
+			c.Response = &http.Response{ProtoMajor: 1, ProtoMinor: 1, StatusCode: http.StatusRequestEntityTooLarge}
+			return
+		}
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/echo", gzipBody(t, strings.Repeat("a", 101)))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	// WHEN
+	resp, err := (&http.Client{Transport: tools.transport}).Do(req)
+
+	// THEN
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
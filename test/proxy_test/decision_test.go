@@ -0,0 +1,125 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const debugHeader = "X-Debug"
+
+func TestHTTPSProxyInterceptsOnlyDebugClients(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	var intercepted atomic.Int32
+	rule := &proxy.Rule{Action: proxy.TunnelAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if c.Request.Method == http.MethodConnect && c.Request.Header.Get(debugHeader) != "" {
+			c.SetAction(proxy.MITMAction)
+		} else if c.Request.Method != http.MethodConnect {
+			intercepted.Add(1)
+		}
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+
+	// WHEN
+	newHttpTools(t, proxyServer.URL, server).AssertHTTPEcho(server.URL, "tunneled")
+	debugTools := newHttpTools(t, proxyServer.URL, server)
+	debugTools.transport.ProxyConnectHeader = http.Header{debugHeader: {"1"}}
+	debugTools.AssertHTTPEcho(server.URL, "intercepted")
+
+	// THEN
+	assert.Equal(t, int32(1), intercepted.Load())
+}
+
+func TestHTTPSProxyBlocksConnectionByHandler(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		c.SetAction(proxy.BlockAction)
+		assert.Equal(t, proxy.BlockAction, c.Action())
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	_, err := tools.HTTPEcho(server.URL, "blocked")
+
+	// THEN
+	assert.ErrorContains(t, err, "Forbidden")
+}
+
+func TestHTTPProxyDirectsRequestToUpstreamAddr(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "other "+r.Host)
+	}))
+	defer otherServer.Close()
+	rule := &proxy.Rule{Handlers: []proxy.Handler{func(c *proxy.Context) {
+		c.SetUpstreamAddr(otherServer.Listener.Addr().String())
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "redirected")
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	content, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	assert.Equal(t, "other "+server.Listener.Addr().String(), string(content))
+}
+
+func TestHTTPSProxyUsesServerTLSConfigOfHandler(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if c.Request.Method == http.MethodConnect {
+			// the rule doesn't trust the certificate of the test server
+			c.SetServerTLSConfig(&tls.Config{RootCAs: rootCAs})
+		}
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		withClientCertificate(server),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "trusted by handler")
+}
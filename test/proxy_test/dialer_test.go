@@ -0,0 +1,100 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// blockingDialer waits until the context is done and passes the error of the context to the channel
+func blockingDialer(errs chan<- error) proxy.Dialer {
+	return dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return nil, ctx.Err()
+	})
+}
+
+func TestHTTPProxyUsesCustomDialer(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	var dialed []string
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, server.Listener.Addr().String())
+	})
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithDialer(dialer),
+		WithTestServer(server, false),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, transparentHost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho("https://"+transparentHost+":8443", "custom dialer")
+	assert.Equal(t, []string{transparentHost + ":8443"}, dialed)
+}
+
+func TestHTTPProxyDialTimeout(t *testing.T) {
+	// GIVEN
+	errs := make(chan error, 1)
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithDialer(blockingDialer(errs)),
+		proxy.WithDialTimeout(50*time.Millisecond),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, respErr := tools.HTTPEcho("http://192.0.2.1:80", "dial timeout")
+
+	// THEN
+	require.NoError(t, respErr)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+}
+
+func TestHTTPProxyClientDisconnectCancelsDial(t *testing.T) {
+	// GIVEN
+	errs := make(chan error, 1)
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithDialer(blockingDialer(errs)),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	conn, dialErr := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(t, dialErr)
+	_, writeErr := fmt.Fprint(conn, "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\n\r\n")
+	require.NoError(t, writeErr)
+
+	// WHEN
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.Close())
+
+	// THEN
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "dial was not cancelled")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"net/http"
+	"sync"
+)
+
+// headerRecorder stores headers and hosts of requests received by the server
+type headerRecorder struct {
+	mu      sync.Mutex
+	headers []http.Header
+	hosts   []string
+}
+
+func (s *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.headers = append(s.headers, r.Header.Clone())
+	s.hosts = append(s.hosts, r.Host)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *headerRecorder) Last() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.headers) == 0 {
+		return nil
+	}
+	return s.headers[len(s.headers)-1]
+}
+
+func (s *headerRecorder) LastHost() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.hosts) == 0 {
+		return ""
+	}
+	return s.hosts[len(s.hosts)-1]
+}
+
+// hopByHopServer responds with hop-by-hop headers that must not reach the client
+type hopByHopServer struct {
+	headerRecorder
+}
+
+func (s *hopByHopServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "X-Server-Option")
+	w.Header().Set("X-Server-Option", "1")
+	w.Header().Set("Keep-Alive", "timeout=5")
+	w.Header().Set("Proxy-Authenticate", "Basic")
+	w.Header().Set("X-End-To-End", "1")
+	s.headerRecorder.ServeHTTP(w, r)
+}
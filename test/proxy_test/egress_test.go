@@ -0,0 +1,188 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rateLimitedServer responds with 429 Too Many Requests to the first request from each source address
+type rateLimitedServer struct {
+	mu      sync.Mutex
+	sources []string
+}
+
+func (s *rateLimitedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	s.mu.Lock()
+	s.sources = append(s.sources, ip)
+	s.mu.Unlock()
+
+	if len(s.Sources()) == 1 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *rateLimitedServer) Sources() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.sources...)
+}
+
+func TestHTTPProxyEgressPoolExcludesRateLimitedAddress(t *testing.T) {
+	// GIVEN
+	recorder := &rateLimitedServer{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	pool, poolErr := proxy.NewEgressPool([]netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")})
+	require.NoError(t, poolErr)
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithEgressPool(pool), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	tools.transport.DisableKeepAlives = true // each request opens a new connection to the server
+
+	// WHEN
+	var statusCodes []int
+	for i := 0; i < 3; i++ {
+		resp, respErr := tools.HTTPEcho(server.URL, "egress pool")
+		require.NoError(t, respErr)
+		_ = resp.Body.Close()
+		statusCodes = append(statusCodes, resp.StatusCode)
+	}
+
+	// THEN
+	assert.Equal(t, []int{http.StatusTooManyRequests, http.StatusOK, http.StatusOK}, statusCodes)
+	assert.Equal(t, []string{"127.0.0.1", "127.0.0.2", "127.0.0.2"}, recorder.Sources())
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats[0].Rejected)
+	assert.Equal(t, uint64(1), stats[0].Total)
+	assert.Equal(t, uint64(2), stats[1].Total)
+}
+
+// keySourceServer records the source addresses of requests by the API key
+type keySourceServer struct {
+	mu      sync.Mutex
+	sources map[string][]string
+}
+
+func (s *keySourceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	s.mu.Lock()
+	s.sources[r.Header.Get("X-Api-Key")] = append(s.sources[r.Header.Get("X-Api-Key")], ip)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestHTTPSProxyEgressPoolSticksToKeyOfInterceptedRequests(t *testing.T) {
+	// GIVEN
+	recorder := &keySourceServer{sources: make(map[string][]string)}
+	server := httptest.NewTLSServer(recorder)
+	defer server.Close()
+	pool, poolErr := proxy.NewEgressPool([]netip.Addr{
+		netip.MustParseAddr("127.0.0.1"),
+		netip.MustParseAddr("127.0.0.2"),
+		netip.MustParseAddr("127.0.0.3"),
+		netip.MustParseAddr("127.0.0.4"),
+	}, proxy.WithEgressStrategy(proxy.StickyKeyEgress), proxy.WithEgressKeyHeader("X-Api-Key"))
+	require.NoError(t, poolErr)
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, true),
+		proxy.WithEgressPool(pool),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	keys := strings.Split("abcdefgh", "")
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			req, reqErr := http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, reqErr)
+			req.Header.Set("X-Api-Key", key)
+			resp, respErr := tools.transport.RoundTrip(req)
+			require.NoError(t, respErr)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// THEN
+	// requests are sent through one intercepted connection, but the address is selected by the key of each request
+	addrs := make(map[string]bool)
+	for _, key := range keys {
+		sources := recorder.sources[key]
+		require.Len(t, sources, 2)
+		assert.Equal(t, sources[0], sources[1], key)
+		addrs[sources[0]] = true
+	}
+	assert.Greater(t, len(addrs), 1)
+}
+
+func TestHTTPSProxyEgressPoolSharesHTTP2ConnectionsOfSameKey(t *testing.T) {
+	// GIVEN
+	recorder := &keySourceServer{sources: make(map[string][]string)}
+	server := httptest.NewUnstartedServer(recorder)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	pool, poolErr := proxy.NewEgressPool([]netip.Addr{
+		netip.MustParseAddr("127.0.0.1"),
+		netip.MustParseAddr("127.0.0.2"),
+		netip.MustParseAddr("127.0.0.3"),
+		netip.MustParseAddr("127.0.0.4"),
+	}, proxy.WithEgressStrategy(proxy.StickyKeyEgress), proxy.WithEgressKeyHeader("X-Api-Key"))
+	require.NoError(t, poolErr)
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, localhost),
+		proxy.WithEgressPool(pool),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+
+	// WHEN
+	keys := strings.Split("abcdefgh", "")
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			// every client opens its own connection to the proxy
+			tools := newHttpTools(t, proxyServer.URL, server)
+			tools.transport.DisableKeepAlives = true
+			req, reqErr := http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, reqErr)
+			req.Header.Set("X-Api-Key", key)
+			resp, respErr := tools.transport.RoundTrip(req)
+			require.NoError(t, respErr)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// THEN
+	// HTTP/2 connections to the server are shared only by requests with the key that selects the same address
+	addrs := make(map[string]bool)
+	for _, key := range keys {
+		sources := recorder.sources[key]
+		require.Len(t, sources, 2)
+		assert.Equal(t, sources[0], sources[1], key)
+		addrs[sources[0]] = true
+	}
+	assert.Greater(t, len(addrs), 1)
+}
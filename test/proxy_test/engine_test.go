@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"strings"
 	"syscall"
@@ -985,3 +986,183 @@ func TestPlainEngineHTTPProxyMITMToWSSPlain(t *testing.T) {
 	require.NoError(t, firstReadErr)
 	require.Equal(t, http.StatusSwitchingProtocols, firstResp.StatusCode)
 }
+
+func TestHTTPProxyResolvesClientIPFromTrustedProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	var clientIPs []string
+	handler := func(c *proxy.Context) {
+		clientIPs = append(clientIPs, c.ClientIP().String())
+		c.Next()
+	}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8")),
+		proxy.WithDefaultRule(&proxy.Rule{Handlers: []proxy.Handler{handler}}),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	reqUrl, reqUrlErr := url.JoinPath(server.URL, "echo")
+	require.NoError(t, reqUrlErr)
+	req, reqErr := http.NewRequest(http.MethodGet, reqUrl, nil)
+	require.NoError(t, reqErr)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 10.0.0.1")
+
+	// WHEN
+	resp, respErr := tools.transport.RoundTrip(req)
+
+	// THEN
+	require.NoError(t, respErr)
+	tools.Close(resp.Body)
+	assert.Equal(t, []string{"10.0.0.1"}, clientIPs)
+}
+
+func TestHTTPProxyMITMToHTTPSAppendsForwardingHeaders(t *testing.T) {
+	// GIVEN
+	recorder := new(headerRecorder)
+	server := httptest.NewTLSServer(recorder)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(WithTestServer(server, false),
+		proxy.WithRule(&proxy.Rule{
+			Action:     proxy.MITMAction,
+			Forwarding: proxy.AppendForwarding,
+		}, localhost)))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	resp, respErr := tools.HTTPEcho(server.URL, "http proxy mitm to https with forwarding headers")
+
+	// THEN
+	require.NoError(t, respErr)
+	tools.Close(resp.Body)
+	header := recorder.Last()
+	if assert.NotNil(t, header) {
+		assert.Equal(t, localhost, header.Get("X-Forwarded-For"))
+		assert.Equal(t, `for=127.0.0.1;host="`+server.Listener.Addr().String()+`";proto=https`, header.Get("Forwarded"))
+		assert.Equal(t, "1.1 glove", header.Get("Via"))
+	}
+}
+
+func TestHTTPProxyToHTTPStripsForwardingHeaders(t *testing.T) {
+	// GIVEN
+	recorder := new(headerRecorder)
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithDefaultRule(&proxy.Rule{
+		Forwarding: proxy.StripForwarding,
+	})))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	req, reqErr := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, reqErr)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("Via", "1.1 client-side-proxy")
+
+	// WHEN
+	resp, respErr := tools.transport.RoundTrip(req)
+
+	// THEN
+	require.NoError(t, respErr)
+	tools.Close(resp.Body)
+	header := recorder.Last()
+	if assert.NotNil(t, header) {
+		assert.Empty(t, header.Values("X-Forwarded-For"))
+		assert.Empty(t, header.Values("Via"))
+	}
+}
+
+func TestHTTPProxyToHTTPRemovesHopByHopHeaders(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(new(hopByHopServer))
+	defer server.Close()
+	recorder := server.Config.Handler.(*hopByHopServer)
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+	req, reqErr := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, reqErr)
+	req.Header.Set("Connection", "X-Client-Option")
+	req.Header.Set("X-Client-Option", "1")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("TE", "gzip")
+	req.Header.Set("X-End-To-End", "1")
+
+	// WHEN
+	resp, respErr := tools.transport.RoundTrip(req)
+
+	// THEN
+	require.NoError(t, respErr)
+	tools.Close(resp.Body)
+	header := recorder.Last()
+	if assert.NotNil(t, header) {
+		for _, name := range []string{"X-Client-Option", "Proxy-Connection", "Proxy-Authorization", "Keep-Alive", "Te"} {
+			assert.Empty(t, header.Values(name), name)
+		}
+		assert.Equal(t, "1", header.Get("X-End-To-End"))
+	}
+	for _, name := range []string{"Connection", "X-Server-Option", "Keep-Alive", "Proxy-Authenticate"} {
+		assert.Empty(t, resp.Header.Values(name), name)
+	}
+	assert.Equal(t, "1", resp.Header.Get("X-End-To-End"))
+}
+
+func TestHTTPProxyTunnelToHTTPSEnforcesServerName(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, SNI: proxy.EnforceSNI}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	tools.transport.TLSClientConfig.ServerName = "example.com"
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "sni mismatch")
+
+	// THEN
+	assert.Nil(t, resp)
+	assert.Error(t, err)
+}
+
+func TestHTTPProxyTunnelToHTTPSAcceptsAllowedServerName(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithRule(&proxy.Rule{
+			Action:             proxy.TunnelAction,
+			SNI:                proxy.EnforceSNI,
+			AllowedServerNames: []string{"*.com"},
+		}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	tools.transport.TLSClientConfig.ServerName = "example.com"
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "sni allowed")
+}
+
+func TestHTTPProxyTunnelToHTTPSLogsServerName(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	logs := &logRecorder{}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, SNI: proxy.LogSNI}, localhost),
+		proxy.WithLogger(zerolog.New(logs))))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	tools.transport.TLSClientConfig.ServerName = "example.com"
+	tools.transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+
+	// WHEN
+	tools.AssertHTTPEcho(server.URL, "sni logged")
+
+	// THEN
+	assert.Contains(t, logs.String(), `"serverName":"example.com","alpn":["http/1.1"],"message":"client-hello"`)
+}
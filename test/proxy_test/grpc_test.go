@@ -0,0 +1,122 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const grpcMethod = "/glove.test.Echo/Echo"
+
+// grpcFrame prefixes the message with the gRPC length-prefixed message header
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// newGRPCServer starts the server that echoes gRPC messages and ends the call with the status sent in trailers
+func newGRPCServer(t *testing.T) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("server: unexpected call %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "echoed")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+func newGRPCRequest(t *testing.T, serverURL, message string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, serverURL+grpcMethod, bytes.NewReader(grpcFrame(message)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	return req
+}
+
+func TestHTTPSProxyPreservesGRPCTrailers(t *testing.T) {
+	// GIVEN
+	server := newGRPCServer(t)
+	defer server.Close()
+	methods := make(chan string, 1)
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if c.IsGRPC() {
+			methods <- c.GRPCMethod()
+		}
+		c.Next()
+	}}}
+	logs := &logRecorder{}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.New(logs))))
+	defer proxyServer.Close()
+	tools := newHTTP2Tools(t, proxyServer.URL, server)
+
+	// WHEN
+	resp, err := tools.transport.RoundTrip(newGRPCRequest(t, server.URL, "ping"))
+
+	// THEN
+	require.NoError(t, err)
+	body, readErr := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, readErr)
+	assert.Equal(t, grpcFrame("ping"), body)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "echoed", resp.Trailer.Get("Grpc-Message"))
+	assert.Equal(t, grpcMethod, <-methods)
+	assert.Contains(t, logs.String(), `"method":"/glove.test.Echo/Echo","grpcStatus":"OK","grpcMessage":"echoed","message":"grpc"`)
+}
+
+func TestHTTPSProxyRejectsGRPCCall(t *testing.T) {
+	// GIVEN
+	server := newGRPCServer(t)
+	defer server.Close()
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if c.GRPCMethod() == grpcMethod {
+			c.RejectGRPC(proxy.GRPCPermissionDenied, "echo is blocked")
+			return
+		}
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHTTP2Tools(t, proxyServer.URL, server)
+
+	// WHEN
+	resp, err := tools.transport.RoundTrip(newGRPCRequest(t, server.URL, "ping"))
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "7", resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "echo is blocked", resp.Header.Get("Grpc-Message"))
+}
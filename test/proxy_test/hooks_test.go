@@ -0,0 +1,164 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// phaseRecorder stores the names of hooks and handlers in the order they are called
+type phaseRecorder struct {
+	mu     sync.Mutex
+	phases []string
+}
+
+func (r *phaseRecorder) record(phase string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.phases = append(r.phases, phase)
+}
+
+func (r *phaseRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return strings.Join(r.phases, ",")
+}
+
+func TestHTTPProxyRunsHooksAroundHandlers(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	phases := &phaseRecorder{}
+	rule := &proxy.Rule{
+		OnRequest: []proxy.Hook{func(c *proxy.Context) { phases.record("request") }},
+		Handlers: []proxy.Handler{func(c *proxy.Context) {
+			phases.record("handler")
+			c.Next()
+		}},
+		OnResponse: []proxy.Hook{func(c *proxy.Context) {
+			phases.record("response")
+			c.Response.Header.Set("X-Audited", "true")
+		}},
+	}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "hooks")
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	assert.Equal(t, "true", resp.Header.Get("X-Audited"))
+	assert.Equal(t, "request,handler,response", phases.String())
+}
+
+func TestHTTPProxyRequestHookAnswersRequest(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	phases := &phaseRecorder{}
+	rule := &proxy.Rule{
+		OnRequest: []proxy.Hook{func(c *proxy.Context) {
+			phases.record("request")
+			c.Response = &http.Response{ProtoMajor: 1, ProtoMinor: 1, StatusCode: http.StatusTooManyRequests}
+		}},
+		Handlers: []proxy.Handler{func(c *proxy.Context) {
+			phases.record("handler")
+			c.Next()
+		}},
+		OnResponse: []proxy.Hook{func(c *proxy.Context) { phases.record("response") }},
+	}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "hooks")
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "request,response", phases.String())
+}
+
+func TestHTTPProxyRunsErrorHooks(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	dialErr := errors.New("dial refused")
+	failingDialer := &net.Dialer{
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			return dialErr
+		},
+	}
+	errs := make(chan error, 1)
+	rule := &proxy.Rule{OnError: []proxy.ErrorHook{func(c *proxy.Context, err error) {
+		errs <- err
+		c.Response = &http.Response{ProtoMajor: 1, ProtoMinor: 1, StatusCode: http.StatusServiceUnavailable}
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithDialer(failingDialer),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "hooks")
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.ErrorIs(t, <-errs, dialErr)
+}
+
+func TestHTTPProxyRunsConnectAndTunnelCloseHooks(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	phases := &phaseRecorder{}
+	stats := make(chan proxy.TunnelStats, 1)
+	rule := &proxy.Rule{
+		OnConnect: []proxy.Hook{func(c *proxy.Context) { phases.record("connect") }},
+		OnRequest: []proxy.Hook{func(c *proxy.Context) { phases.record("request") }},
+		OnTunnelClose: []proxy.TunnelCloseHook{func(c *proxy.Context, s proxy.TunnelStats) {
+			phases.record("tunnel-close")
+			stats <- s
+		}},
+	}
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	tools.AssertHTTPEcho(server.URL, "tunneled")
+	tools.transport.CloseIdleConnections()
+
+	// THEN
+	tunnelStats := <-stats
+	assert.Positive(t, tunnelStats.BytesSent)
+	assert.Positive(t, tunnelStats.BytesReceived)
+	assert.Positive(t, tunnelStats.Duration)
+	assert.Equal(t, "connect,tunnel-close", phases.String())
+}
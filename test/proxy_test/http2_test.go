@@ -0,0 +1,287 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newHTTP2Tools returns tools of the client that prefers HTTP/2 for HTTPS requests
+func newHTTP2Tools(t *testing.T, proxyUrl string, server *httptest.Server) *testTools {
+	tools := newHttpTools(t, proxyUrl, server)
+	tools.transport.ForceAttemptHTTP2 = true
+	return tools
+}
+
+// withClientCertificate presents the certificate of the test server to clients without restricting ALPN protocols
+func withClientCertificate(server *httptest.Server) proxy.EngineOption {
+	return proxy.WithClientConfig(func(host string) (*tls.Config, error) {
+		return &tls.Config{Certificates: server.TLS.Certificates}, nil
+	})
+}
+
+func TestHTTPSProxyServesHTTP2Clients(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	var streams atomic.Int32
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		if c.Request.ProtoMajor == 2 {
+			streams.Add(1)
+		}
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHTTP2Tools(t, proxyServer.URL, server)
+
+	// WHEN
+	var wg sync.WaitGroup
+	protos := make(chan string, 10)
+	for i := 0; i < cap(protos); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			message := fmt.Sprintf("stream %d", i)
+			resp, err := tools.HTTPEcho(server.URL, message)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer tools.Close(resp.Body)
+
+			content, readErr := io.ReadAll(resp.Body)
+			assert.NoError(t, readErr)
+			assert.Equal(t, message, string(content))
+			protos <- resp.Proto
+		}(i)
+	}
+	wg.Wait()
+	close(protos)
+
+	// THEN
+	require.Len(t, protos, 10)
+	for proto := range protos {
+		assert.Equal(t, "HTTP/2.0", proto)
+	}
+	assert.Equal(t, int32(10), streams.Load())
+}
+
+func TestHTTPSProxyFallsBackToHTTP1(t *testing.T) {
+	for name, disableHTTP2 := range map[string]bool{"enabled": false, "disabled": true} {
+		t.Run(name, func(t *testing.T) {
+			// GIVEN
+			server := httptest.NewTLSServer(newEchoServer(t))
+			defer server.Close()
+			proxyServer := httptest.NewServer(proxy.NewEngine(
+				WithTestServer(server, false),
+				withClientCertificate(server),
+				proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction, DisableHTTP2: disableHTTP2}, localhost),
+				proxy.WithLogger(zerolog.Nop())))
+			defer proxyServer.Close()
+			tools := newHttpTools(t, proxyServer.URL, server)
+			if !disableHTTP2 {
+				// the client doesn't offer h2
+				tools.transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			} else {
+				tools.transport.ForceAttemptHTTP2 = true
+			}
+
+			// WHEN
+			resp, err := tools.HTTPEcho(server.URL, "fallback")
+
+			// THEN
+			require.NoError(t, err)
+			defer tools.Close(resp.Body)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "HTTP/1.1", resp.Proto)
+		})
+	}
+}
+
+func TestHTTPSProxyReconnectsToServerClosingConnection(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHTTP2Tools(t, proxyServer.URL, server)
+
+	for _, path := range []string{"/first", "/second", "/third"} {
+		// WHEN
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		resp, err := tools.transport.RoundTrip(req)
+
+		// THEN
+		require.NoError(t, err)
+		content, readErr := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		require.NoError(t, readErr)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, path, string(content))
+	}
+}
+
+// newHTTP2Server starts the echo server that negotiates HTTP/2 and counts accepted connections
+func newHTTP2Server(t *testing.T, protos chan<- string) (*httptest.Server, *atomic.Int32) {
+	echo := newEchoServer(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if protos != nil {
+			protos <- r.Proto
+		}
+		echo.ServeHTTP(w, r)
+	}))
+	var conns atomic.Int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server, &conns
+}
+
+func TestHTTPSProxySharesHTTP2ConnectionsToServer(t *testing.T) {
+	// GIVEN
+	protos := make(chan string, 3)
+	server, conns := newHTTP2Server(t, protos)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+
+	// WHEN
+	for i := 0; i < cap(protos); i++ {
+		// every client opens its own connection to the proxy
+		tools := newHttpTools(t, proxyServer.URL, server)
+		tools.transport.DisableKeepAlives = true
+		tools.AssertHTTPEcho(server.URL, fmt.Sprintf("client %d", i))
+	}
+
+	// THEN
+	close(protos)
+	for proto := range protos {
+		assert.Equal(t, "HTTP/2.0", proto)
+	}
+	assert.Equal(t, int32(1), conns.Load())
+}
+
+func TestHTTPSProxyDoesNotShareHTTP2ConnectionsOfOtherServerNames(t *testing.T) {
+	// GIVEN
+	server, conns := newHTTP2Server(t, nil)
+	defer server.Close()
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{func(c *proxy.Context) {
+		// both hosts are directed to the same address
+		c.SetUpstreamAddr(server.Listener.Addr().String())
+		c.Next()
+	}}}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithDefaultRule(rule),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+
+	// WHEN
+	for i, host := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		tools := newHttpTools(t, proxyServer.URL, server)
+		tools.transport.DisableKeepAlives = true
+		tools.AssertHTTPEcho("https://"+host, fmt.Sprintf("client %d", i))
+	}
+
+	// THEN
+	// the certificate of the server is verified for each host
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestHTTPSProxyServesHTTP2ClientsUsingHTTP2Server(t *testing.T) {
+	// GIVEN
+	protos := make(chan string, 1)
+	server, _ := newHTTP2Server(t, protos)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHTTP2Tools(t, proxyServer.URL, server)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "h2 end-to-end")
+
+	// THEN
+	require.NoError(t, err)
+	defer tools.Close(resp.Body)
+	content, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	assert.Equal(t, "h2 end-to-end", string(content))
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "HTTP/2.0", <-protos)
+}
+
+func TestHTTPSProxyDisablesHTTP2ToServer(t *testing.T) {
+	// GIVEN
+	protos := make(chan string, 1)
+	server, _ := newHTTP2Server(t, protos)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction, DisableServerHTTP2: true}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	tools.AssertHTTPEcho(server.URL, "http/1.1 only")
+
+	// THEN
+	assert.Equal(t, "HTTP/1.1", <-protos)
+}
+
+func TestHTTPSProxyUpgradesWebsocketWithHTTP2Server(t *testing.T) {
+	// GIVEN
+	server, _ := newHTTP2Server(t, nil)
+	defer server.Close()
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		withClientCertificate(server),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertWebsocketEcho(server.URL, "websocket")
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// exchangeHost doesn't resolve, so it can be reached only using the static hosts
+const exchangeHost = "exchange.invalid"
+
+var loopbackHosts = map[string][]netip.Addr{
+	exchangeHost:    {netip.MustParseAddr("127.0.0.1")},
+	transparentHost: {netip.MustParseAddr("127.0.0.1")},
+}
+
+func TestHTTPProxyResolvesStaticHostsOfRule(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	logs := &logRecorder{}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, Hosts: loopbackHosts}, exchangeHost),
+		proxy.WithLogger(zerolog.New(logs))))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	tools.AssertHTTPEcho(fmt.Sprintf("http://%s:%s", exchangeHost, port), "static host")
+
+	// THEN
+	assert.Contains(t, logs.String(), fmt.Sprintf(`"host":"%s","ip":"127.0.0.1:%s","source":"rule","message":"resolve"`, exchangeHost, port))
+}
+
+func TestHTTPSProxyResolvesStaticHostsOfRule(t *testing.T) {
+	for name, action := range map[string]proxy.Action{"tunnel": proxy.TunnelAction, "mitm": proxy.MITMAction} {
+		t.Run(name, func(t *testing.T) {
+			// GIVEN
+			server := httptest.NewTLSServer(newEchoServer(t))
+			defer server.Close()
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			proxyServer := httptest.NewServer(proxy.NewEngine(
+				WithTestServer(server, false),
+				proxy.WithRule(&proxy.Rule{Action: action, Hosts: loopbackHosts}, transparentHost),
+				proxy.WithLogger(zerolog.Nop())))
+			defer proxyServer.Close()
+			tools := newHttpTools(t, proxyServer.URL, server)
+
+			// WHEN-THEN
+			tools.AssertHTTPEcho(fmt.Sprintf("https://%s:%s", transparentHost, port), "static host")
+		})
+	}
+}
+
+func TestHTTPProxyResolvesStaticHostsOfResolver(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	resolver, err := proxy.NewResolver(proxy.WithStaticHost(exchangeHost, netip.MustParseAddr("127.0.0.1")))
+	assert.NoError(t, err)
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithResolver(resolver),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(fmt.Sprintf("http://%s:%s", exchangeHost, port), "static host")
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newRewriteEngine returns the engine intercepting connections and rewriting requests using the YAML config
+func newRewriteEngine(t *testing.T, server *httptest.Server, config string) *proxy.Engine {
+	rewriteConfig, parseErr := proxy.ParseRewriteConfig([]byte(config))
+	require.NoError(t, parseErr)
+	rewrite, rewriteErr := proxy.NewRewriteHandler(rewriteConfig)
+	require.NoError(t, rewriteErr)
+	rule := &proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{rewrite}}
+	return proxy.NewEngine(WithTestServer(server, false), proxy.WithRule(rule, localhost), proxy.WithLogger(zerolog.Nop()))
+}
+
+func TestHTTPSProxyRewritesRequestAndResponse(t *testing.T) {
+	// GIVEN
+	t.Setenv("REWRITE_API_KEY", "secret")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Powered-By", "origin")
+		_, _ = fmt.Fprintf(w, `{"path":%q,"apiKey":%q,"body":%s}`, r.URL.Path, r.Header.Get("X-Api-Key"), body)
+	}))
+	defer server.Close()
+	proxyServer := httptest.NewServer(newRewriteEngine(t, server, `
+rules:
+  - match:
+      host: "127.0.0.*"
+      methods: [POST]
+      path: ^/v1/
+    path:
+      pattern: ^/v1/
+      replacement: /v2/
+    request:
+      setHeaders:
+        X-Api-Key: '{{ env "REWRITE_API_KEY" }}'
+      setJSON:
+        user.role: admin
+    response:
+      removeHeaders: [X-Powered-By]
+      replaceText:
+        - old: secret
+          new: redacted
+`))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	client := &http.Client{Transport: tools.transport}
+
+	// WHEN
+	resp, err := client.Post(server.URL+"/v1/users", "application/json", strings.NewReader(`{"user":{"name":"alice"}}`))
+
+	// THEN
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	assert.Empty(t, resp.Header.Get("X-Powered-By"))
+	var document map[string]any
+	require.NoError(t, json.Unmarshal(body, &document))
+	assert.Equal(t, map[string]any{
+		"path":   "/v2/users",
+		"apiKey": "redacted",
+		"body":   map[string]any{"user": map[string]any{"name": "alice", "role": "admin"}},
+	}, document)
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+}
+
+func TestHTTPSProxyDoesNotRewriteUnmatchedRequest(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyServer := httptest.NewServer(newRewriteEngine(t, server, `
+rules:
+  - match:
+      path: ^/other
+    request:
+      replaceText:
+        - old: hello
+          new: goodbye
+`))
+	defer proxyServer.Close()
+
+	// WHEN
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// THEN
+	tools.AssertHTTPEcho(server.URL, "hello")
+}
+
+func TestHTTPProxyRewritesUpstream(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "other")
+	}))
+	defer otherServer.Close()
+	proxyServer := httptest.NewServer(newRewriteEngine(t, server, fmt.Sprintf(`
+rules:
+  - upstream: %s
+`, otherServer.Listener.Addr())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "hello")
+
+	// THEN
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "other", string(body))
+}
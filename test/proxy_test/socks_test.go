@@ -0,0 +1,217 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	netproxy "golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newSOCKSServer(t *testing.T, engine *proxy.Engine, opts ...proxy.SOCKSOption) string {
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+
+	server := proxy.NewSOCKSServer(engine, opts...)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+		assert.ErrorIs(t, <-done, proxy.ErrSOCKSServerClosed)
+	})
+	return listener.Addr().String()
+}
+
+func newSOCKSClient(t *testing.T, proxyAddr string, auth *netproxy.Auth, rootCAs ...*httptest.Server) *http.Client {
+	dialer, dialerErr := netproxy.SOCKS5("tcp", proxyAddr, auth, netproxy.Direct)
+	require.NoError(t, dialerErr)
+
+	tools := newHttpTools(t, "http://"+proxyAddr, rootCAs...)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.(netproxy.ContextDialer).DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{RootCAs: tools.rootCAs},
+		},
+	}
+}
+
+func assertSOCKSEcho(t *testing.T, client *http.Client, serverUrl, message string) {
+	resp, respErr := client.Post(serverUrl+"/echo", "text/plain", strings.NewReader(message))
+	require.NoError(t, respErr)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	content, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	assert.Equal(t, message, string(content))
+}
+
+func TestSOCKSTunnelToHTTPS(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	client := newSOCKSClient(t, proxyAddr, nil, server)
+
+	// WHEN-THEN
+	assertSOCKSEcho(t, client, server.URL, "socks tunnel to https")
+}
+
+func TestSOCKSTunnelToHTTPByDomain(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	proxyAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	client := newSOCKSClient(t, proxyAddr, nil)
+	_, port, splitErr := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, splitErr)
+
+	// WHEN-THEN
+	assertSOCKSEcho(t, client, "http://localhost:"+port, "socks tunnel to http by domain")
+}
+
+func TestSOCKSMITMToHTTPSUsesHandlers(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	mid := new(mockMiddleware)
+	mid.On("Run", mock.Anything)
+	engine := proxy.NewEngine(WithTestServer(server, true),
+		proxy.WithRule(&proxy.Rule{
+			Action:   proxy.MITMAction,
+			Handlers: []proxy.Handler{mid.Run},
+		}, localhost),
+		proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newSOCKSServer(t, engine)
+	client := newSOCKSClient(t, proxyAddr, nil, server)
+
+	// WHEN-THEN
+	assertSOCKSEcho(t, client, server.URL, "socks mitm to https")
+	mid.AssertNumberOfCalls(t, "Run", 2)
+}
+
+func TestSOCKSBlockRule(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	engine := proxy.NewEngine(proxy.WithRule(&proxy.Rule{Action: proxy.BlockAction}, localhost),
+		proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newSOCKSServer(t, engine)
+	dialer, dialerErr := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
+	require.NoError(t, dialerErr)
+
+	// WHEN
+	conn, dialErr := dialer.Dial("tcp", server.Listener.Addr().String())
+
+	// THEN
+	assert.Nil(t, conn)
+	assert.ErrorContains(t, dialErr, "connection not allowed by ruleset")
+}
+
+func TestSOCKSUnreachableHost(t *testing.T) {
+	// GIVEN
+	proxyAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	dialer, dialerErr := netproxy.SOCKS5("tcp", proxyAddr, nil, netproxy.Direct)
+	require.NoError(t, dialerErr)
+
+	// WHEN
+	conn, dialErr := dialer.Dial("tcp", "127.0.0.1:9999")
+
+	// THEN
+	assert.Nil(t, conn)
+	assert.ErrorContains(t, dialErr, "host unreachable")
+}
+
+func TestSOCKSAuthentication(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	authenticator := proxy.WithSOCKSAuthenticator(func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})
+	proxyAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())), authenticator)
+
+	// WHEN-THEN
+	client := newSOCKSClient(t, proxyAddr, &netproxy.Auth{User: "user", Password: "secret"})
+	assertSOCKSEcho(t, client, server.URL, "socks with authentication")
+
+	for _, auth := range []*netproxy.Auth{nil, {User: "user", Password: "wrong"}} {
+		dialer, dialerErr := netproxy.SOCKS5("tcp", proxyAddr, auth, netproxy.Direct)
+		require.NoError(t, dialerErr)
+
+		conn, dialErr := dialer.Dial("tcp", server.Listener.Addr().String())
+		assert.Nil(t, conn)
+		assert.Error(t, dialErr)
+	}
+}
+
+func TestSOCKSServerRejectsServeAfterClose(t *testing.T) {
+	// GIVEN
+	server := proxy.NewSOCKSServer(proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	require.NoError(t, server.Close())
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	defer func() { _ = listener.Close() }()
+
+	// WHEN
+	err := server.Serve(listener)
+
+	// THEN
+	assert.True(t, errors.Is(err, proxy.ErrSOCKSServerClosed))
+}
+
+// failingListener returns the error from the first Accept call, as if the process ran out of file descriptors
+type failingListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestSOCKSServerRetriesAcceptError(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	socksServer := proxy.NewSOCKSServer(proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	done := make(chan error, 1)
+	go func() {
+		done <- socksServer.Serve(&failingListener{Listener: listener})
+	}()
+	client := newSOCKSClient(t, listener.Addr().String(), nil)
+	client.Timeout = 5 * time.Second
+
+	// WHEN-THEN
+	assertSOCKSEcho(t, client, server.URL, "socks after accept error")
+	require.NoError(t, socksServer.Close())
+	assert.ErrorIs(t, <-done, proxy.ErrSOCKSServerClosed)
+}
@@ -17,11 +17,32 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 )
 
 const localhost = "127.0.0.1"
 
+// logRecorder stores log messages written by the engine
+type logRecorder struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (r *logRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.b.Write(p)
+}
+
+func (r *logRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.b.String()
+}
+
 func newEmptyReaderWriter() *bufio.ReadWriter {
 	return bufio.NewReadWriter(
 		bufio.NewReader(bytes.NewReader([]byte{})),
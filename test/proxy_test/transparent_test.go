@@ -0,0 +1,225 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// transparentHost is covered by the certificate of httptest servers
+const transparentHost = "example.com"
+
+// withTransparentHost resolves the transparent host to the address
+func withTransparentHost(t *testing.T, addr string) proxy.EngineOption {
+	resolver, err := proxy.NewResolver(proxy.WithStaticHost(transparentHost, netip.MustParseAddr(addr)))
+	require.NoError(t, err)
+	return proxy.WithResolver(resolver)
+}
+
+func newTransparentServer(t *testing.T, engine *proxy.Engine, server *httptest.Server, opts ...proxy.TransparentOption) string {
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+
+	// connections are redirected to the test server as if the firewall intercepted them
+	destination := proxy.WithTransparentDestination(func(conn net.Conn) (*net.TCPAddr, error) {
+		return server.Listener.Addr().(*net.TCPAddr), nil
+	})
+	transparentServer := proxy.NewTransparentServer(engine, append([]proxy.TransparentOption{destination}, opts...)...)
+	done := make(chan error, 1)
+	go func() {
+		done <- transparentServer.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		require.NoError(t, transparentServer.Close())
+		assert.ErrorIs(t, <-done, proxy.ErrTransparentServerClosed)
+	})
+	return listener.Addr().String()
+}
+
+func newTransparentClient(proxyAddr string, server *httptest.Server) *http.Client {
+	rootCAs := x509.NewCertPool()
+	if cert := server.Certificate(); cert != nil {
+		rootCAs.AddCert(cert)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, proxyAddr)
+			},
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		},
+	}
+}
+
+func assertTransparentEcho(t *testing.T, client *http.Client, serverUrl, message string) {
+	resp, respErr := client.Post(serverUrl+"/echo", "text/plain", strings.NewReader(message))
+	require.NoError(t, respErr)
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	content, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	assert.Equal(t, message, string(content))
+}
+
+func TestTransparentProxyToHTTP(t *testing.T) {
+	// GIVEN
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	mid := new(mockMiddleware)
+	mid.On("Run", mock.Anything)
+	engine := proxy.NewEngine(
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, Handlers: []proxy.Handler{mid.Run}}, transparentHost),
+		proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newTransparentServer(t, engine, server)
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN
+	resp, respErr := client.Get("http://" + transparentHost + "/")
+
+	// THEN
+	require.NoError(t, respErr)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, transparentHost, recorder.LastHost())
+	mid.AssertNumberOfCalls(t, "Run", 1)
+}
+
+func TestTransparentProxyTunnelToHTTPS(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyAddr := newTransparentServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())), server)
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN-THEN
+	assertTransparentEcho(t, client, "https://"+transparentHost, "transparent tunnel to https")
+}
+
+func TestTransparentProxyMITMToHTTPSUsesServerName(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	mid := new(mockMiddleware)
+	mid.On("Run", mock.Anything)
+	engine := proxy.NewEngine(WithTestServer(server, false),
+		proxy.WithRule(&proxy.Rule{Action: proxy.MITMAction, Handlers: []proxy.Handler{mid.Run}}, transparentHost),
+		proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newTransparentServer(t, engine, server)
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN-THEN
+	assertTransparentEcho(t, client, "https://"+transparentHost, "transparent mitm to https")
+	mid.AssertNumberOfCalls(t, "Run", 2)
+}
+
+func TestTransparentProxyBlockRuleClosesConnection(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	engine := proxy.NewEngine(proxy.WithRule(&proxy.Rule{Action: proxy.BlockAction}, transparentHost),
+		proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newTransparentServer(t, engine, server)
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN
+	resp, respErr := client.Get("https://" + transparentHost + "/")
+
+	// THEN
+	assert.Nil(t, resp)
+	assert.Error(t, respErr)
+}
+
+// newSpoofingTransparentEngine returns the engine that tunnels only the transparent host, which resolves to another
+// address than the destination of connections
+func newSpoofingTransparentEngine(t *testing.T) *proxy.Engine {
+	return proxy.NewEngine(
+		proxy.WithDefaultRule(&proxy.Rule{Action: proxy.BlockAction}),
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction}, transparentHost),
+		withTransparentHost(t, "192.0.2.1"),
+		proxy.WithLogger(zerolog.Nop()))
+}
+
+func TestTransparentProxyVerifiesHostResolvesToDestination(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	engine := proxy.NewEngine(withTransparentHost(t, "127.0.0.1"), proxy.WithLogger(zerolog.Nop()))
+	proxyAddr := newTransparentServer(t, engine, server, proxy.WithTransparentHostCheck())
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN-THEN
+	assertTransparentEcho(t, client, "https://"+transparentHost, "transparent tunnel to verified host")
+}
+
+func TestTransparentProxyRejectsServerNameOfAnotherDestination(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyAddr := newTransparentServer(t, newSpoofingTransparentEngine(t), server, proxy.WithTransparentHostCheck())
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN
+	// the client connects to the blocked destination using the server name of the allowed host
+	resp, respErr := client.Get("https://" + transparentHost + "/")
+
+	// THEN
+	assert.Nil(t, resp)
+	assert.Error(t, respErr)
+}
+
+func TestTransparentProxyTrustsServerNameWithoutHostCheck(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyAddr := newTransparentServer(t, newSpoofingTransparentEngine(t), server)
+	client := newTransparentClient(proxyAddr, server)
+
+	// WHEN-THEN
+	// the rule is selected by the server name, which isn't resolved
+	assertTransparentEcho(t, client, "https://"+transparentHost, "transparent tunnel without host check")
+}
+
+func TestTransparentProxyClosesConnectionWithoutDestination(t *testing.T) {
+	// GIVEN
+	listener, listenErr := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, listenErr)
+	destination := proxy.WithTransparentDestination(func(conn net.Conn) (*net.TCPAddr, error) {
+		return nil, errors.New("not redirected")
+	})
+	transparentServer := proxy.NewTransparentServer(proxy.NewEngine(proxy.WithLogger(zerolog.Nop())), destination)
+	go func() { _ = transparentServer.Serve(listener) }()
+	defer func() { _ = transparentServer.Close() }()
+
+	conn, dialErr := net.Dial("tcp4", listener.Addr().String())
+	require.NoError(t, dialErr)
+	defer func() { _ = conn.Close() }()
+
+	// WHEN
+	_, readErr := conn.Read(make([]byte, 1))
+
+	// THEN
+	assert.ErrorIs(t, readErr, io.EOF)
+}
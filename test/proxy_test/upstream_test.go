@@ -0,0 +1,255 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// upstreamProxy is a parent proxy that requires the basic authentication and counts requests it accepted
+type upstreamProxy struct {
+	engine   *proxy.Engine
+	username string
+	password string
+
+	mu       sync.Mutex
+	methods  []string
+	rejected int
+}
+
+func newUpstreamProxy(username, password string) *upstreamProxy {
+	return &upstreamProxy{
+		engine:   proxy.NewEngine(proxy.WithLogger(zerolog.Nop())),
+		username: username,
+		password: password,
+	}
+}
+
+func (p *upstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+
+	p.mu.Lock()
+	if r.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+		p.rejected += 1
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.methods = append(p.methods, r.Method)
+	p.mu.Unlock()
+
+	p.engine.ServeHTTP(w, r)
+}
+
+func (p *upstreamProxy) Methods() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.methods...)
+}
+
+func (p *upstreamProxy) Rejected() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rejected
+}
+
+func newUpstream(t *testing.T, rawURL string, opts ...proxy.UpstreamProxyOption) *proxy.UpstreamProxy {
+	upstream, upstreamErr := proxy.NewUpstreamProxy(rawURL, opts...)
+	require.NoError(t, upstreamErr)
+	return upstream
+}
+
+func TestHTTPProxyTunnelToHTTPSThroughUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewServer(parent)
+	defer parentServer.Close()
+	upstream := newUpstream(t, "http://user:secret@"+parentServer.Listener.Addr().String())
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "tunnel through upstream proxy")
+	assert.Equal(t, []string{http.MethodConnect}, parent.Methods())
+}
+
+func TestHTTPProxyMITMToHTTPSThroughUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewServer(parent)
+	defer parentServer.Close()
+	upstream := newUpstream(t, "http://user:secret@"+parentServer.Listener.Addr().String())
+	proxyServer := httptest.NewServer(proxy.NewEngine(WithTestServer(server, true),
+		proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "mitm through upstream proxy")
+	assert.Equal(t, []string{http.MethodConnect}, parent.Methods())
+}
+
+func TestHTTPProxyToHTTPForwardsToUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewServer(parent)
+	defer parentServer.Close()
+	upstream := newUpstream(t, "http://user:secret@"+parentServer.Listener.Addr().String())
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "forward to upstream proxy")
+	assert.Equal(t, []string{http.MethodGet}, parent.Methods())
+}
+
+func TestHTTPProxyTunnelToHTTPSThroughHTTPSUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewTLSServer(parent)
+	defer parentServer.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(parentServer.Certificate())
+	upstream := newUpstream(t, "https://user:secret@"+parentServer.Listener.Addr().String(),
+		proxy.WithUpstreamTLSConfig(&tls.Config{RootCAs: rootCAs}))
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "tunnel through https upstream proxy")
+	assert.Equal(t, []string{http.MethodConnect}, parent.Methods())
+}
+
+func TestHTTPProxyTunnelToHTTPSThroughSOCKSUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	authenticator := proxy.WithSOCKSAuthenticator(func(username, password string) bool {
+		return username == "user" && password == "secret"
+	})
+	parentAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())), authenticator)
+	upstream := newUpstream(t, "socks5://user:secret@"+parentAddr)
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "tunnel through socks upstream proxy")
+}
+
+func TestHTTPProxyResolvesHostsForSOCKSUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	parentAddr := newSOCKSServer(t, proxy.NewEngine(proxy.WithLogger(zerolog.Nop())))
+	newProxy := func(scheme string) *httptest.Server {
+		upstream := newUpstream(t, scheme+"://"+parentAddr)
+		return httptest.NewServer(proxy.NewEngine(
+			proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, Hosts: loopbackHosts, Upstream: upstream}, exchangeHost),
+			proxy.WithLogger(zerolog.Nop())))
+	}
+	localProxy, remoteProxy := newProxy("socks5"), newProxy("socks5h")
+	defer localProxy.Close()
+	defer remoteProxy.Close()
+	exchangeURL := fmt.Sprintf("http://%s:%s", exchangeHost, port)
+
+	// WHEN-THEN
+	newHttpTools(t, localProxy.URL).AssertHTTPEcho(exchangeURL, "resolved by the proxy")
+	resp, err := newHttpTools(t, remoteProxy.URL).HTTPEcho(exchangeURL, "resolved by the parent proxy")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestHTTPProxyRuleUpstreamProxyOverridesDefault(t *testing.T) {
+	// GIVEN
+	server := httptest.NewServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewServer(parent)
+	defer parentServer.Close()
+	unreachable := newUpstream(t, "http://127.0.0.1:9")
+	upstream := newUpstream(t, "http://user:secret@"+parentServer.Listener.Addr().String())
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		proxy.WithUpstreamProxy(unreachable),
+		proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, Upstream: upstream}, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN-THEN
+	tools.AssertHTTPEcho(server.URL, "rule upstream proxy")
+	assert.Equal(t, []string{http.MethodGet}, parent.Methods())
+}
+
+func TestHTTPProxyBypassesUpstreamProxy(t *testing.T) {
+	for name, engineOpt := range map[string]proxy.EngineOption{
+		"no proxy":    proxy.WithUpstreamProxy(newUpstream(t, "http://127.0.0.1:9", proxy.WithNoProxy("example.com, 127.0.0.0/8"))),
+		"direct rule": proxy.WithRule(&proxy.Rule{Action: proxy.TunnelAction, Upstream: proxy.DirectUpstream}, localhost),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// GIVEN
+			server := httptest.NewTLSServer(newEchoServer(t))
+			defer server.Close()
+			proxyServer := httptest.NewServer(proxy.NewEngine(
+				proxy.WithUpstreamProxy(newUpstream(t, "http://127.0.0.1:9")),
+				engineOpt,
+				proxy.WithLogger(zerolog.Nop())))
+			defer proxyServer.Close()
+			tools := newHttpTools(t, proxyServer.URL, server)
+
+			// WHEN-THEN
+			tools.AssertHTTPEcho(server.URL, "bypass upstream proxy")
+		})
+	}
+}
+
+func TestHTTPProxyTunnelToHTTPSRejectedByUpstreamProxy(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	parent := newUpstreamProxy("user", "secret")
+	parentServer := httptest.NewServer(parent)
+	defer parentServer.Close()
+	upstream := newUpstream(t, "http://user:wrong@"+parentServer.Listener.Addr().String())
+	proxyServer := httptest.NewServer(proxy.NewEngine(proxy.WithUpstreamProxy(upstream), proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+
+	// WHEN
+	resp, err := tools.HTTPEcho(server.URL, "rejected by upstream proxy")
+
+	// THEN
+	assert.Nil(t, resp)
+	assert.ErrorContains(t, err, "Bad Gateway")
+	assert.Equal(t, 1, parent.Rejected())
+}
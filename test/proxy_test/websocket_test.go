@@ -0,0 +1,174 @@
+/*
+ * Copyright 2023 The Glove Authors. All rights reserved.
+ * Use of this source code is governed by a BSD-style license that can be found in the LICENSE file.
+ */
+
+package proxy_test
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"github.com/pmateusz/glove/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWebsocketProxy starts the proxy that intercepts connections to the server and passes websocket messages to the
+// handlers
+func newWebsocketProxy(server *httptest.Server, handlers ...proxy.WebsocketHandler) *httptest.Server {
+	rule := &proxy.Rule{Action: proxy.MITMAction, WebsocketHandlers: handlers}
+	return httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+}
+
+func TestHTTPSProxyModifiesWebsocketMessages(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyServer := newWebsocketProxy(server, func(c *proxy.WebsocketContext) {
+		if c.Message.Type == proxy.WebsocketText && c.Message.Direction == proxy.ServerToClient {
+			c.Message.Data = []byte(strings.ToUpper(string(c.Message.Data)))
+		}
+		c.Next()
+	})
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	wsConn, _, dialErr := tools.DialWebsocket(server.URL)
+	require.NoError(t, dialErr)
+	defer tools.Close(wsConn)
+
+	// WHEN
+	writeErr := wsConn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, message, readErr := wsConn.ReadMessage()
+
+	// THEN
+	require.NoError(t, writeErr)
+	require.NoError(t, readErr)
+	assert.Equal(t, "HELLO", string(message))
+}
+
+func TestHTTPSProxyDropsAndInjectsWebsocketMessages(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	proxyServer := newWebsocketProxy(server, func(c *proxy.WebsocketContext) {
+		if string(c.Message.Data) == "secret" {
+			// the client is answered by the proxy and the message is never sent to the server
+			_ = c.Send(&proxy.WebsocketMessage{
+				Direction: proxy.ServerToClient,
+				Type:      proxy.WebsocketText,
+				Data:      []byte("dropped"),
+			})
+			return
+		}
+		c.Next()
+	})
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	wsConn, _, dialErr := tools.DialWebsocket(server.URL)
+	require.NoError(t, dialErr)
+	defer tools.Close(wsConn)
+
+	for _, message := range []string{"secret", "public"} {
+		// WHEN
+		writeErr := wsConn.WriteMessage(websocket.TextMessage, []byte(message))
+		_, reply, readErr := wsConn.ReadMessage()
+
+		// THEN
+		require.NoError(t, writeErr)
+		require.NoError(t, readErr)
+		if message == "secret" {
+			assert.Equal(t, "dropped", string(reply))
+		} else {
+			assert.Equal(t, message, string(reply))
+		}
+	}
+}
+
+func TestHTTPSProxyRunsTunnelCloseHooksOfInspectedWebsockets(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(newEchoServer(t))
+	defer server.Close()
+	stats := make(chan proxy.TunnelStats, 1)
+	rule := &proxy.Rule{
+		Action:            proxy.MITMAction,
+		WebsocketHandlers: []proxy.WebsocketHandler{func(c *proxy.WebsocketContext) { c.Next() }},
+		OnTunnelClose: []proxy.TunnelCloseHook{func(c *proxy.Context, s proxy.TunnelStats) {
+			stats <- s
+		}},
+	}
+	proxyServer := httptest.NewServer(proxy.NewEngine(
+		WithTestServer(server, false),
+		proxy.WithRule(rule, localhost),
+		proxy.WithLogger(zerolog.Nop())))
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	wsConn, _, dialErr := tools.DialWebsocket(server.URL)
+	require.NoError(t, dialErr)
+	require.NoError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, _, readErr := wsConn.ReadMessage()
+	require.NoError(t, readErr)
+
+	// WHEN
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	require.NoError(t, wsConn.WriteMessage(websocket.CloseMessage, closeMessage))
+	tools.Close(wsConn)
+
+	// THEN
+	var tunnelStats proxy.TunnelStats
+	select {
+	case tunnelStats = <-stats:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "tunnel close hook did not run")
+	}
+	assert.Positive(t, tunnelStats.BytesSent)
+	assert.Positive(t, tunnelStats.BytesReceived)
+	assert.Positive(t, tunnelStats.Duration)
+}
+
+func TestHTTPSProxyInspectsCompressedWebsocketMessages(t *testing.T) {
+	// GIVEN
+	server := httptest.NewTLSServer(&echoServer{t, websocket.Upgrader{EnableCompression: true}})
+	defer server.Close()
+	messages := make(chan string, 4)
+	proxyServer := newWebsocketProxy(server, func(c *proxy.WebsocketContext) {
+		if c.Message.Type == proxy.WebsocketText {
+			messages <- c.Message.Direction.String() + ": " + string(c.Message.Data)
+		}
+		c.Next()
+	})
+	defer proxyServer.Close()
+	tools := newHttpTools(t, proxyServer.URL, server)
+	dialer := &websocket.Dialer{
+		Proxy:             tools.Proxy,
+		TLSClientConfig:   &tls.Config{RootCAs: tools.rootCAs},
+		EnableCompression: true,
+	}
+	wsConn, resp, dialErr := dialer.Dial(strings.Replace(server.URL, "https", "wss", 1)+"/echo", nil)
+	require.NoError(t, dialErr)
+	defer tools.Close(wsConn)
+	require.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	wsConn.EnableWriteCompression(true)
+
+	for _, message := range []string{"compressed message", "compressed message"} {
+		// WHEN
+		writeErr := wsConn.WriteMessage(websocket.TextMessage, []byte(message))
+		_, reply, readErr := wsConn.ReadMessage()
+
+		// THEN
+		require.NoError(t, writeErr)
+		require.NoError(t, readErr)
+		assert.Equal(t, message, string(reply))
+		assert.Equal(t, "client-to-server: "+message, <-messages)
+		assert.Equal(t, "server-to-client: "+message, <-messages)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}